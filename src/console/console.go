@@ -0,0 +1,324 @@
+package console
+
+/*
+	Console transport: reads messages from stdin and prints bot output.
+	It feeds the same callbacks as glb does, so toads can be tested without
+	any XMPP server.
+
+	Every line is a message from the current nick. Lines starting with /
+	fake room events:
+
+		/as <nick>          speak as another nick (joins it if needed)
+		/nick <nick>        change current nick
+		/join <nick>        somebody joins the room
+		/leave <nick>       somebody leaves the room
+		/op <nick>          grant moderator
+		/deop <nick>        revoke moderator
+		/private <text>     send private message to the bot
+		/subject <text>     change room subject
+		/who                list room occupants
+		/quit               disconnect
+		//text              message starting with /
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"glb"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	// stdin can be read only once, so it's shared by all the bots
+	input     = make(chan string)
+	inputOnce sync.Once
+)
+
+type (
+	Bot struct {
+		sync.Mutex
+
+		config    *Config
+		cb        interface{}
+		nick      string
+		occupants map[string]bool // nick -> admin
+		done      chan bool
+		stop      chan bool
+		stopOnce  sync.Once
+	}
+
+	Config struct {
+		Nick    string // who is talking
+		Admin   bool   // whether the nick is a moderator
+		BotNick string `yaml:"bot_nick"`
+	}
+)
+
+func readInput() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		input <- scanner.Text()
+	}
+
+	// ^D stops the bot just like ^C does
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+}
+
+func New(cb interface{}) *Bot {
+	return &Bot{
+		cb:        cb,
+		occupants: make(map[string]bool),
+		done:      make(chan bool, 1),
+		stop:      make(chan bool),
+	}
+}
+
+func (b *Bot) Connect(config *Config) {
+
+	if config.Nick == "" {
+		config.Nick = "developer"
+	}
+
+	if config.BotNick == "" {
+		config.BotNick = "zhobe"
+	}
+
+	b.config = config
+	b.nick = config.Nick
+
+	inputOnce.Do(func() {
+		go readInput()
+	})
+
+	go func() {
+		if cb, ok := b.cb.(glb.OnConnect); ok {
+			cb.OnConnect()
+		}
+
+		b.presence(config.BotNick, true, true)
+		b.presence(config.Nick, true, config.Admin)
+
+		b.printf("* connected as %v, talking as %v", config.BotNick, config.Nick)
+
+		for {
+			select {
+			case line := <-input:
+				b.handleLine(line)
+			case <-b.stop:
+				if cb, ok := b.cb.(glb.OnDisconnect); ok {
+					cb.OnDisconnect(nil)
+				}
+				b.done <- true
+				return
+			}
+		}
+	}()
+}
+
+func (b *Bot) handleLine(line string) {
+
+	if line == "" {
+		return
+	}
+
+	if !strings.HasPrefix(line, "/") || strings.HasPrefix(line, "//") {
+		b.message(strings.TrimPrefix(line, "/"), false)
+		return
+	}
+
+	var (
+		tokens = strings.SplitN(line[1:], " ", 2)
+		arg    string
+	)
+
+	if len(tokens) > 1 {
+		arg = strings.TrimSpace(tokens[1])
+	}
+
+	switch tokens[0] {
+	case "as":
+		if arg == "" {
+			b.printf("* usage: /as <nick>")
+			return
+		}
+
+		b.Lock()
+		_, online := b.occupants[arg]
+		b.nick = arg
+		b.Unlock()
+
+		if !online {
+			b.presence(arg, true, false)
+		}
+	case "nick":
+		b.rename(arg)
+	case "join":
+		b.presence(arg, true, false)
+	case "leave":
+		b.presence(arg, false, false)
+	case "op":
+		b.presence(arg, true, true)
+	case "deop":
+		b.presence(arg, true, false)
+	case "private":
+		b.message(arg, true)
+	case "subject":
+		if cb, ok := b.cb.(glb.OnMUCSubject); ok {
+			go cb.OnMUCSubject(b.speaker(), arg)
+		}
+	case "who":
+		b.printf("* %v", strings.Join(b.who(), ", "))
+	case "quit":
+		b.Disconnect()
+	default:
+		b.printf("* unknown command: %v", tokens[0])
+	}
+}
+
+func (b *Bot) speaker() string {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.nick
+}
+
+func (b *Bot) who() []string {
+	b.Lock()
+	defer b.Unlock()
+
+	var result []string
+	for nick, admin := range b.occupants {
+		if admin {
+			nick = "@" + nick
+		}
+		result = append(result, nick)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+func (b *Bot) message(body string, private bool) {
+	if cb, ok := b.cb.(glb.OnMUCMessage); ok {
+		go cb.OnMUCMessage(&glb.MUCMessage{
+			Body:    body,
+			From:    b.speaker(),
+			Private: private,
+		})
+	}
+}
+
+// current speaker changes the nick
+func (b *Bot) rename(to string) {
+
+	if to == "" {
+		b.printf("* usage: /nick <nick>")
+		return
+	}
+
+	b.Lock()
+	var (
+		from  = b.nick
+		admin = b.occupants[from]
+	)
+	b.nick = to
+	b.Unlock()
+
+	b.emit(from, false, false, to)
+	b.presence(to, true, admin)
+}
+
+func (b *Bot) presence(nick string, online, admin bool) {
+	b.emit(nick, online, admin, "")
+}
+
+func (b *Bot) emit(nick string, online, admin bool, newNick string) {
+
+	if nick == "" {
+		return
+	}
+
+	b.Lock()
+	if online {
+		b.occupants[nick] = admin
+	} else {
+		delete(b.occupants, nick)
+	}
+	b.Unlock()
+
+	var (
+		affiliation = glb.AffiliationNone
+		role        = glb.RoleParticipant
+	)
+
+	if admin {
+		affiliation, role = glb.AffiliationAdmin, glb.RoleModerator
+	}
+
+	if !online {
+		role = glb.RoleNone
+	}
+
+	if cb, ok := b.cb.(glb.OnMUCPresence); ok {
+		go cb.OnMUCPresence(&glb.MUCPresence{
+			Nick:        nick,
+			NewNick:     newNick,
+			Online:      online,
+			Admin:       online && admin,
+			Self:        nick == b.config.BotNick,
+			Affiliation: affiliation,
+			Role:        role,
+		})
+	}
+}
+
+func (b *Bot) printf(format string, args ...interface{}) {
+	b.Lock()
+	defer b.Unlock()
+
+	fmt.Printf(format+"\n", args...)
+}
+
+func (b *Bot) Free() {}
+
+func (b *Bot) Disconnect() {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+	})
+}
+
+func (b *Bot) Leave(goodbye string) {
+	if goodbye != "" {
+		b.printf("* %v has left: %v", b.config.BotNick, goodbye)
+	}
+	b.Disconnect()
+}
+
+func (b *Bot) Wait() {
+	<-b.done
+}
+
+func (b *Bot) Nickname() string {
+	return b.config.BotNick
+}
+
+func (b *Bot) Send(message string) {
+	b.printf("<%v> %v", b.config.BotNick, message)
+}
+
+func (b *Bot) SendPrivate(message, recipient string) {
+	b.printf("<%v -> %v> %v", b.config.BotNick, recipient, message)
+}
+
+func (b *Bot) SetSubject(subject string) {
+	b.printf("* %v changed the subject to: %v", b.config.BotNick, subject)
+}
+
+func (b *Bot) Kick(who, forWhat string) {
+	b.printf("* %v was kicked by %v (%v)", who, b.config.BotNick, forWhat)
+	b.presence(who, false, false)
+}
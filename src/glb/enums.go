@@ -54,6 +54,23 @@ var (
 		"NonSaslNotAcceptable",
 		"NonSaslNotAuthorized",
 	}
+
+	Affiliations = []string{
+		"none",
+		"outcast",
+		"member",
+		"owner",
+		"admin",
+		"invalid",
+	}
+
+	Roles = []string{
+		"none",
+		"visitor",
+		"participant",
+		"moderator",
+		"invalid",
+	}
 )
 
 const (
@@ -77,7 +94,9 @@ const (
 	ConnErrAuthenticationFailed
 	ConnErrUserDisconnected
 	ConnErrNotConnected
+)
 
+const (
 	// Auth Errors
 	AuthErrUndefined = AuthenticationError(iota)
 	AuthErrSaslAborted
@@ -91,7 +110,9 @@ const (
 	AuthErrNonSaslConflict
 	AuthErrNonSaslNotAcceptable
 	AuthErrNonSaslNotAuthorized
+)
 
+const (
 	// Presence Types
 	PresenceAvailable = PresenceType(iota)
 	PresenceChat
@@ -102,7 +123,9 @@ const (
 	PresenceProbe
 	PresenceError
 	PresenceInvalid
+)
 
+const (
 	// Affiliations
 	AffiliationNone = Affiliation(iota)
 	AffiliationOutcast
@@ -110,7 +133,9 @@ const (
 	AffiliationOwner
 	AffiliationAdmin
 	AffiliationInvalid
+)
 
+const (
 	// Roles
 	RoleNone = Role(iota)
 	RoleVisitor
@@ -126,3 +151,17 @@ func (d DisconnectError) Error() string {
 		AuthenticationErrors[d.AuthenticationError],
 	)
 }
+
+func (a Affiliation) String() string {
+	if int(a) < len(Affiliations) {
+		return Affiliations[a]
+	}
+	return Affiliations[AffiliationInvalid]
+}
+
+func (r Role) String() string {
+	if int(r) < len(Roles) {
+		return Roles[r]
+	}
+	return Roles[RoleInvalid]
+}
@@ -2,6 +2,10 @@
 #include "gloox.hpp"
 #include "gloox.h"
 
+#include <cstdlib>
+
+// strings come from C.CString, so they are malloc-ed and freed here
+
 GBot BotInit() {
     Bot* ret = new Bot();
     return (void *)ret;
@@ -10,7 +14,9 @@ GBot BotInit() {
 void BotConnect(GBot b, char *jid, char *pwd, char *room) {
     auto bot = (Bot*) b;
     bot->start(jid, pwd, room);
-    delete jid, pwd, room;
+    free(jid);
+    free(pwd);
+    free(room);
 }
 
 void BotDisconnect(GBot b) {
@@ -18,6 +24,12 @@ void BotDisconnect(GBot b) {
     bot->stop();
 }
 
+void BotLeave(GBot b, char *goodbye) {
+    auto bot = (Bot*) b;
+    bot->stop(goodbye);
+    free(goodbye);
+}
+
 void BotFree(GBot b) {
     auto bot = (Bot *) b;
     delete bot;
@@ -26,19 +38,27 @@ void BotFree(GBot b) {
 void BotReply(GBot b, char *what) {
     auto bot = (Bot *) b;
     bot->reply(what);
-    delete what;
+    free(what);
 }
 
 void BotReplyPrivate(GBot b, char *what, char *whom) {
     auto bot = (Bot *) b;
     bot->reply_private(what, whom);
-    delete what, whom;
+    free(what);
+    free(whom);
 }
 
 void BotKick(GBot b, char *who, char *reason) {
     auto bot = (Bot *) b;
     bot->kick(who, reason);
-    delete who, reason;
+    free(who);
+    free(reason);
+}
+
+void BotSetSubject(GBot b, char *subject) {
+    auto bot = (Bot *) b;
+    bot->set_subject(subject);
+    free(subject);
 }
 
 char *BotNick(GBot b) {
@@ -50,3 +70,58 @@ void BotPingRoom(GBot b) {
     auto bot = (Bot *) b;
     bot->ping();
 }
+
+void BotSetVersion(GBot b, char *name, char *version, char *os) {
+    auto bot = (Bot *) b;
+    bot->set_version(name, version, os);
+    free(name);
+    free(version);
+    free(os);
+}
+
+void BotAddFeature(GBot b, char *feature) {
+    auto bot = (Bot *) b;
+    bot->add_feature(feature);
+    free(feature);
+}
+
+void BotAddCommand(GBot b, char *node, char *name, char *usage) {
+    auto bot = (Bot *) b;
+    bot->add_command(node, name, usage);
+    free(node);
+    free(name);
+    free(usage);
+}
+
+void BotRemoveCommand(GBot b, char *node) {
+    auto bot = (Bot *) b;
+    bot->remove_command(node);
+    free(node);
+}
+
+void BotRespondCommand(GBot b, char *to, char *node, char *session, char *output) {
+    auto bot = (Bot *) b;
+    bot->respond_command(to, node, session, output);
+    free(to);
+    free(node);
+    free(session);
+    free(output);
+}
+
+void BotPublishVCard(GBot b, char *fn, char *desc, char *url, char *type, char *binval) {
+    auto bot = (Bot *) b;
+    bot->publish_vcard(fn, desc, url, type, binval);
+    free(fn);
+    free(desc);
+    free(url);
+    free(type);
+    free(binval);
+}
+
+void BotPublishAvatar(GBot b, char *id, char *type, char *data, int bytes, int width, int height) {
+    auto bot = (Bot *) b;
+    bot->publish_avatar(id, type, data, bytes, width, height);
+    free(id);
+    free(type);
+    free(data);
+}
@@ -5,6 +5,8 @@ package glb
 import "C"
 
 import (
+	"crypto/sha1"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"sync"
@@ -36,20 +38,42 @@ type (
 		Nickname   string
 		SkipTLS    bool          `yaml:"skip_tls"` // all hail to cx
 		IQTimeout  time.Duration `yaml:"iq_timeout"`
+		Avatar     string        // path to avatar image
+		VCard      VCard         `yaml:"vcard"`
+	}
+
+	VCard struct {
+		FullName    string `yaml:"full_name"`
+		Description string
+		URL         string
 	}
 
 	MUCMessage struct {
 		Body    string
 		From    string
+		JID     string // bare JID of the sender, only when it is known for sure
 		History bool
 		Private bool
 	}
 
 	MUCPresence struct {
-		Nick   string
-		Online bool
-		Admin  bool
-		Self   bool
+		Nick        string
+		JID         string // bare, empty if room is anonymous
+		OccupantID  string // XEP-0421 if supported by the server (user@host for irc)
+		NewNick     string // set when the occupant changes the nick
+		Online      bool
+		Admin       bool
+		Self        bool
+		Affiliation Affiliation
+		Role        Role
+	}
+
+	// XEP-0050 command submitted by some client
+	AdhocCommand struct {
+		From    string // full JID of the requester
+		Node    string
+		Session string
+		Args    string
 	}
 
 	// callback interfaces
@@ -72,6 +96,21 @@ type (
 	OnMUCSubject interface {
 		OnMUCSubject(from, subject string)
 	}
+
+	OnAdhocCommand interface {
+		OnAdhocCommand(*AdhocCommand)
+	}
+
+	// the server has answered all the PublishVCard and PublishAvatar iqs
+	OnProfilePublished interface {
+		OnProfilePublished(ok bool)
+	}
+
+	// decides who may run ad-hoc commands at all, nobody by default;
+	// called synchronously, so it must not call the bot
+	OnAdhocAccess interface {
+		OnAdhocAccess(from string) bool
+	}
 )
 
 // Get go bot object reference by C void pointer
@@ -151,6 +190,10 @@ func (b *GBot) PingRoom() {
 	b.Lock()
 	defer b.Unlock()
 
+	if b.freed() {
+		return
+	}
+
 	C.BotPingRoom(b.cobj)
 }
 
@@ -197,11 +240,14 @@ func goOnMessage(cobj C.GBot, raw_from, raw_msg *C.char, raw_history, raw_privat
 }
 
 //export goOnPresence
-func goOnPresence(cobj C.GBot, raw_nick *C.char, raw_self, raw_presence, raw_affiliation, raw_role C.int) {
+func goOnPresence(cobj C.GBot, raw_nick, raw_jid, raw_occupant, raw_new_nick *C.char, raw_self, raw_presence, raw_affiliation, raw_role C.int) {
 
 	var (
 		bot         = instance(cobj)
 		nick        = C.GoString(raw_nick)
+		jid         = C.GoString(raw_jid)
+		occupant    = C.GoString(raw_occupant)
+		newNick     = C.GoString(raw_new_nick)
 		self        = raw_self > 0
 		presence    = PresenceType(raw_presence)
 		affiliation = Affiliation(raw_affiliation)
@@ -236,10 +282,15 @@ func goOnPresence(cobj C.GBot, raw_nick *C.char, raw_self, raw_presence, raw_aff
 
 		if cb, ok := bot.cb.(OnMUCPresence); ok {
 			cb.OnMUCPresence(&MUCPresence{
-				Nick:   nick,
-				Online: online,
-				Admin:  admin,
-				Self:   self,
+				Nick:        nick,
+				JID:         jid,
+				OccupantID:  occupant,
+				NewNick:     newNick,
+				Online:      online,
+				Admin:       admin,
+				Self:        self,
+				Affiliation: affiliation,
+				Role:        role,
 			})
 		}
 	}()
@@ -261,6 +312,55 @@ func goOnMUCSubject(cobj C.GBot, raw_nick, raw_subject *C.char) {
 	}()
 }
 
+//export goOnAdhocCommand
+func goOnAdhocCommand(cobj C.GBot, raw_from, raw_node, raw_session, raw_args *C.char) {
+
+	var (
+		bot     = instance(cobj)
+		from    = C.GoString(raw_from)
+		node    = C.GoString(raw_node)
+		session = C.GoString(raw_session)
+		args    = C.GoString(raw_args)
+	)
+
+	go func() {
+		if cb, ok := bot.cb.(OnAdhocCommand); ok {
+			cb.OnAdhocCommand(&AdhocCommand{
+				From:    from,
+				Node:    node,
+				Session: session,
+				Args:    args,
+			})
+		}
+	}()
+}
+
+//export goOnAdhocAccess
+func goOnAdhocAccess(cobj C.GBot, raw_from *C.char) C.int {
+
+	var (
+		bot  = instance(cobj)
+		from = C.GoString(raw_from)
+	)
+
+	if cb, ok := bot.cb.(OnAdhocAccess); ok && cb.OnAdhocAccess(from) {
+		return C.int(1)
+	}
+
+	return C.int(0)
+}
+
+//export goOnProfilePublished
+func goOnProfilePublished(cobj C.GBot, ok bool) {
+	var bot = instance(cobj)
+
+	go func() {
+		if cb, found := bot.cb.(OnProfilePublished); found {
+			cb.OnProfilePublished(ok)
+		}
+	}()
+}
+
 //export goOnPing
 func goOnPing(cobj C.GBot, success bool) {
 	var bot = instance(cobj)
@@ -282,7 +382,17 @@ func (b *GBot) Free() {
 	b.Lock()
 	defer b.Unlock()
 
+	if b.freed() {
+		return
+	}
+
 	C.BotFree(b.cobj)
+	b.cobj = nil
+}
+
+// freed bot ignores everything, handlers may still have it after reconnect
+func (b *GBot) freed() bool {
+	return b.cobj == nil
 }
 
 func (b *GBot) Connect(config *Config) {
@@ -310,18 +420,40 @@ func (b *GBot) Disconnect() {
 	b.Lock()
 	defer b.Unlock()
 
+	if b.freed() {
+		return
+	}
+
 	if !b.disconnecting {
 		b.disconnecting = true
 		C.BotDisconnect(b.cobj)
 	}
 }
 
+// Leave leaves the room with goodbye as status and disconnects
+func (b *GBot) Leave(goodbye string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.freed() {
+		return
+	}
+
+	if !b.disconnecting {
+		b.disconnecting = true
+		C.BotLeave(b.cobj, C.CString(goodbye))
+	}
+}
+
 func (b *GBot) Nickname() string {
 	b.Lock()
-	nick := C.BotNick(b.cobj)
-	b.Unlock()
+	defer b.Unlock()
 
-	return C.GoString(nick)
+	if b.freed() {
+		return ""
+	}
+
+	return C.GoString(C.BotNick(b.cobj))
 }
 
 func (b *GBot) Send(message string) {
@@ -329,6 +461,10 @@ func (b *GBot) Send(message string) {
 	b.Lock()
 	defer b.Unlock()
 
+	if b.freed() {
+		return
+	}
+
 	C.BotReply(
 		b.cobj,
 		C.CString(message),
@@ -339,6 +475,10 @@ func (b *GBot) SendPrivate(message, recipient string) {
 	b.Lock()
 	defer b.Unlock()
 
+	if b.freed() {
+		return
+	}
+
 	C.BotReplyPrivate(
 		b.cobj,
 		C.CString(message),
@@ -350,6 +490,10 @@ func (b *GBot) Kick(who, forWhat string) {
 	b.Lock()
 	defer b.Unlock()
 
+	if b.freed() {
+		return
+	}
+
 	C.BotKick(
 		b.cobj,
 		C.CString(who),
@@ -357,6 +501,156 @@ func (b *GBot) Kick(who, forWhat string) {
 	)
 }
 
+func (b *GBot) SetSubject(subject string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.freed() {
+		return
+	}
+
+	C.BotSetSubject(b.cobj, C.CString(subject))
+}
+
 func (b *GBot) Wait() {
 	<-b.done
 }
+
+// SetVersion sets XEP-0092 software version, call it before Connect
+func (b *GBot) SetVersion(name, version, os string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.freed() {
+		return
+	}
+
+	C.BotSetVersion(
+		b.cobj,
+		C.CString(name),
+		C.CString(version),
+		C.CString(os),
+	)
+}
+
+// AddFeature adds disco#info feature, call it before Connect
+func (b *GBot) AddFeature(feature string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.freed() {
+		return
+	}
+
+	C.BotAddFeature(b.cobj, C.CString(feature))
+}
+
+// AddCommand exposes XEP-0050 command, or updates the exposed one
+func (b *GBot) AddCommand(node, name, usage string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.freed() {
+		return
+	}
+
+	C.BotAddCommand(
+		b.cobj,
+		C.CString(node),
+		C.CString(name),
+		C.CString(usage),
+	)
+}
+
+// RemoveCommand hides XEP-0050 command added before
+func (b *GBot) RemoveCommand(node string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.freed() {
+		return
+	}
+
+	C.BotRemoveCommand(b.cobj, C.CString(node))
+}
+
+// RespondCommand completes XEP-0050 command session
+func (b *GBot) RespondCommand(cmd *AdhocCommand, output string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.freed() {
+		return
+	}
+
+	C.BotRespondCommand(
+		b.cobj,
+		C.CString(cmd.From),
+		C.CString(cmd.Node),
+		C.CString(cmd.Session),
+		C.CString(output),
+	)
+}
+
+// PublishProfile publishes the vCard and, if there is a photo, the avatar
+// at once, so OnProfilePublished is about all of them
+func (b *GBot) PublishProfile(vcard VCard, photoType string, photo []byte, width, height int) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.freed() {
+		return
+	}
+
+	b.publishVCard(vcard, photoType, photo)
+	if len(photo) > 0 {
+		b.publishAvatar(fmt.Sprintf("%x", sha1.Sum(photo)), photoType, photo, width, height)
+	}
+}
+
+// PublishVCard stores vcard-temp, photo is optional
+func (b *GBot) PublishVCard(vcard VCard, photoType string, photo []byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.freed() {
+		return
+	}
+
+	b.publishVCard(vcard, photoType, photo)
+}
+
+func (b *GBot) publishVCard(vcard VCard, photoType string, photo []byte) {
+	C.BotPublishVCard(
+		b.cobj,
+		C.CString(vcard.FullName),
+		C.CString(vcard.Description),
+		C.CString(vcard.URL),
+		C.CString(photoType),
+		C.CString(base64.StdEncoding.EncodeToString(photo)),
+	)
+}
+
+// PublishAvatar publishes XEP-0084 user avatar, id is SHA-1 of the image
+func (b *GBot) PublishAvatar(id, photoType string, photo []byte, width, height int) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.freed() {
+		return
+	}
+
+	b.publishAvatar(id, photoType, photo, width, height)
+}
+
+func (b *GBot) publishAvatar(id, photoType string, photo []byte, width, height int) {
+	C.BotPublishAvatar(
+		b.cobj,
+		C.CString(id),
+		C.CString(photoType),
+		C.CString(base64.StdEncoding.EncodeToString(photo)),
+		C.int(len(photo)),
+		C.int(width),
+		C.int(height),
+	)
+}
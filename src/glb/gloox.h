@@ -8,11 +8,20 @@ extern "C" {
     void BotFree(GBot);
     void BotConnect(GBot, char*, char*, char*);
     void BotDisconnect(GBot);
+    void BotLeave(GBot, char*);
     void BotReply(GBot, char*);
     void BotReplyPrivate(GBot, char*, char*);
     void BotKick(GBot, char*, char*);
+    void BotSetSubject(GBot, char*);
     char* BotNick(GBot);
     void BotPingRoom(GBot);
+    void BotSetVersion(GBot, char*, char*, char*);
+    void BotAddFeature(GBot, char*);
+    void BotAddCommand(GBot, char*, char*, char*);
+    void BotRemoveCommand(GBot, char*);
+    void BotRespondCommand(GBot, char*, char*, char*, char*);
+    void BotPublishVCard(GBot, char*, char*, char*, char*, char*);
+    void BotPublishAvatar(GBot, char*, char*, char*, int, int, int);
 
 #ifdef __cplusplus
 };
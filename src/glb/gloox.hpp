@@ -16,6 +16,11 @@
 #include "gloox/error.h"
 #include "gloox/eventhandler.h"
 #include "gloox/messagesession.h"
+#include "gloox/adhoc.h"
+#include "gloox/adhoccommandprovider.h"
+#include "gloox/iqhandler.h"
+#include "gloox/stanzaextension.h"
+#include "gloox/tag.h"
 
 using namespace gloox;
 using namespace std;
@@ -23,16 +28,113 @@ using namespace std;
 #include <stdio.h>
 #include <locale.h>
 #include <string>
+#include <vector>
+#include <map>
 
 #include <cstdio> // [s]print[f]
 #include <iostream>
 
-class Bot : public ConnectionListener, MUCRoomHandler, LogHandler, EventHandler {
+// what the iq results are about
+enum IqContext {
+    ContextNone = 0,
+    ContextProfile, // vCard and avatar publishing
+};
+
+// wraps prepared payload into an iq
+class RawExtension : public StanzaExtension {
+  public:
+    RawExtension(Tag *payload) : StanzaExtension(ExtUser + 1), m_payload(payload) {}
+    virtual ~RawExtension() { delete m_payload; }
+
+    virtual const std::string& filterString() const {
+        static const std::string filter = "/iq/*";
+        return filter;
+    }
+
+    virtual StanzaExtension* newInstance(const Tag* tag) const { return 0; }
+    virtual Tag* tag() const { return m_payload->clone(); }
+    virtual StanzaExtension* clone() const { return new RawExtension(m_payload->clone()); }
+
+  private:
+    Tag *m_payload;
+};
+
+#define ExtOccupantId (ExtUser + 2)
+
+// XEP-0421 anonymous unique occupant identifier
+class OccupantId : public StanzaExtension {
+  public:
+    OccupantId(const Tag* tag = 0) : StanzaExtension(ExtOccupantId) {
+        if (tag) {
+            m_id = tag->findAttribute("id");
+        }
+    }
+
+    const std::string& id() const { return m_id; }
+
+    virtual const std::string& filterString() const {
+        static const std::string filter = "/presence/occupant-id[@xmlns='urn:xmpp:occupant-id:0']";
+        return filter;
+    }
+
+    virtual StanzaExtension* newInstance(const Tag* tag) const { return new OccupantId(tag); }
+
+    virtual Tag* tag() const {
+        auto t = new Tag("occupant-id", "xmlns", "urn:xmpp:occupant-id:0");
+        t->addAttribute("id", m_id);
+        return t;
+    }
+
+    virtual StanzaExtension* clone() const { return new OccupantId(*this); }
+
+  private:
+    std::string m_id;
+};
+
+struct Command {
+    std::string node;
+    std::string name;
+    std::string usage;
+};
+
+class Bot : public ConnectionListener, MUCRoomHandler, LogHandler, EventHandler, AdhocCommandProvider, IqHandler {
   public:
 
-    Bot() {}
+    Bot() : m_adhoc(0), m_profile_pending(0), m_profile_failed(false) {}
     virtual ~Bot() {}
 
+    // those must be called before start()
+    void set_version(char *name, char *version, char *os) {
+        v_name = name;
+        v_version = version;
+        v_os = os;
+    }
+
+    void add_feature(char *feature) {
+        features.push_back(std::string(feature));
+    }
+
+    // commands can be changed while connected as well
+    void add_command(char *node, char *name, char *usage) {
+        Command cmd = { node, name, usage };
+        if (m_adhoc && commands.count(cmd.node)) {
+            m_adhoc->removeAdhocCommandProvider(cmd.node);
+        }
+        commands[cmd.node] = cmd;
+        if (m_adhoc) {
+            m_adhoc->registerAdhocCommandProvider(this, cmd.node, cmd.name);
+        }
+    }
+
+    void remove_command(char *node) {
+        if (!commands.erase(node)) {
+            return;
+        }
+        if (m_adhoc) {
+            m_adhoc->removeAdhocCommandProvider(node);
+        }
+    }
+
     void start(char *uname, char *pwd, char *muc) {
       jid = new JID(uname);
 
@@ -40,6 +142,23 @@ class Bot : public ConnectionListener, MUCRoomHandler, LogHandler, EventHandler
       j->registerConnectionListener(this);
       j->setPresence( Presence::Available, -1 );
       j->setCompression( false );
+      j->registerStanzaExtension(new OccupantId());
+
+      // disco#info and XEP-0092 software version
+      if (!v_name.empty()) {
+          j->disco()->setVersion(v_name, v_version, v_os);
+          j->disco()->setIdentity("client", "bot", v_name);
+      }
+
+      for (auto &feature : features) {
+          j->disco()->addFeature(feature);
+      }
+
+      // XEP-0050 ad-hoc commands
+      m_adhoc = new Adhoc(j);
+      for (auto &it : commands) {
+          m_adhoc->registerAdhocCommandProvider(this, it.second.node, it.second.name);
+      }
 
     //  j->logInstance().registerLogHandler( LogLevelDebug, LogAreaAll, this );
 
@@ -47,6 +166,10 @@ class Bot : public ConnectionListener, MUCRoomHandler, LogHandler, EventHandler
 
       m_room = new MUCRoom(j, *muc_jid, this, 0);
 
+      // results of the iqs sent before a reconnect never come
+      m_profile_pending = 0;
+      m_profile_failed = false;
+
       if(j->connect(false)) {
         ConnectionError ce = ConnNoError;
         while(ce == ConnNoError) {
@@ -59,12 +182,15 @@ class Bot : public ConnectionListener, MUCRoomHandler, LogHandler, EventHandler
       delete jid;
       delete muc_jid;
       delete m_room;
+      delete m_adhoc;
       delete j;
+
+      m_adhoc = 0;
     }
 
-    void stop() {
+    void stop(const std::string& goodbye = "") {
         if (m_room) {
-            m_room->leave();
+            m_room->leave(goodbye);
         }
 
         j->disconnect();
@@ -118,6 +244,124 @@ class Bot : public ConnectionListener, MUCRoomHandler, LogHandler, EventHandler
         }
     }
 
+    void respond_command(char *to, char *node, char *session, char *output) {
+        if (!m_adhoc) {
+            return;
+        }
+
+        auto form = new DataForm(TypeResult, commands[node].name);
+        form->addField(DataFormField::TypeTextMulti, "output", output, "Output");
+
+        m_adhoc->respond(JID(to), new Adhoc::Command(node, session, Adhoc::Command::Completed, form));
+    }
+
+    // vcard-temp
+    void publish_vcard(char *fn, char *desc, char *url, char *type, char *binval) {
+        auto vcard = new Tag("vCard");
+        vcard->setXmlns("vcard-temp");
+
+        if (*fn) new Tag(vcard, "FN", fn);
+        if (*desc) new Tag(vcard, "DESC", desc);
+        if (*url) new Tag(vcard, "URL", url);
+
+        if (*binval) {
+            auto photo = new Tag(vcard, "PHOTO");
+            new Tag(photo, "TYPE", type);
+            new Tag(photo, "BINVAL", binval);
+        }
+
+        send_raw(vcard, ContextProfile);
+    }
+
+    // XEP-0084 user avatar: data first, then metadata
+    void publish_avatar(char *id, char *type, char *data, int bytes, int width, int height) {
+        auto payload = new Tag("data", data);
+        payload->setXmlns("urn:xmpp:avatar:data");
+        send_raw(pubsub_item("urn:xmpp:avatar:data", id, payload), ContextProfile);
+
+        auto metadata = new Tag("metadata");
+        metadata->setXmlns("urn:xmpp:avatar:metadata");
+
+        auto info = new Tag(metadata, "info");
+        info->addAttribute("id", id);
+        info->addAttribute("type", type);
+        info->addAttribute("bytes", bytes);
+        if (width > 0 && height > 0) {
+            info->addAttribute("width", width);
+            info->addAttribute("height", height);
+        }
+
+        send_raw(pubsub_item("urn:xmpp:avatar:metadata", id, metadata), ContextProfile);
+    }
+
+    virtual bool handleIq(const IQ& iq) {
+        return false;
+    }
+
+    virtual void handleIqID(const IQ& iq, int context) {
+        if (context == ContextProfile) {
+            // the profile is published once the server accepts all of it
+            m_profile_failed = m_profile_failed || iq.subtype() != IQ::Result;
+            if (--m_profile_pending == 0) {
+                goOnProfilePublished(this, !m_profile_failed);
+                m_profile_failed = false;
+            }
+            return;
+        }
+
+        if (iq.subtype() == IQ::Error) {
+            goOnError(this, iq.error() ? iq.error()->error() : 0);
+        }
+    }
+
+    virtual void handleAdhocCommand(const JID& from, const Adhoc::Command& command, const std::string& sessionID) {
+        auto it = commands.find(command.node());
+        if (it == commands.end()) {
+            return;
+        }
+
+        if (command.action() == Adhoc::Command::Cancel) {
+            m_adhoc->respond(from, new Adhoc::Command(command.node(), sessionID, Adhoc::Command::Canceled));
+            return;
+        }
+
+        auto submitted = command.form();
+        if (!submitted) {
+            // first step: ask for the arguments
+            auto form = new DataForm(TypeForm, it->second.name);
+            form->addField(DataFormField::TypeTextSingle, "args", "", it->second.usage);
+
+            m_adhoc->respond(from, new Adhoc::Command(command.node(), sessionID, Adhoc::Command::Executing, form));
+            return;
+        }
+
+        std::string args;
+        auto field = submitted->field("args");
+        if (field) {
+            args = field->value();
+        }
+
+        // the answer is sent later with respond_command
+        goOnAdhocCommand(
+                this,
+                (char*) from.full().c_str(),
+                (char*) command.node().c_str(),
+                (char*) sessionID.c_str(),
+                (char*) args.c_str()
+        );
+    }
+
+    virtual bool handleAdhocAccessRequest(const JID& from, const std::string& command) {
+        // strangers are turned away, commands check permissions by themselves
+        return goOnAdhocAccess(this, (char*) from.full().c_str()) != 0;
+    }
+
+    void set_subject(char *subject) {
+        if (m_room) {
+            m_room->setSubject(std::string(subject));
+        }
+    }
+
     virtual void handleLog( LogLevel level, LogArea area, const std::string& message ) {
       printf("log: level: %d, area: %d, %s\n", level, area, message.c_str() );
     }
@@ -155,9 +399,24 @@ class Bot : public ConnectionListener, MUCRoomHandler, LogHandler, EventHandler
 
         auto nick = participant.nick != NULL ? (char *) participant.nick->resource().c_str() : NULL;
 
+        // real jid is known only in non-anonymous rooms (or to moderators)
+        std::string jid = participant.jid != NULL ? participant.jid->bare() : "";
+
+        std::string occupant;
+        auto oid = presence.findExtension<OccupantId>(ExtOccupantId);
+        if (oid) {
+            occupant = oid->id();
+        }
+
+        // set on unavailable presence when somebody changes the nick
+        std::string newNick = (participant.flags & UserNickChanged) ? participant.newNick : "";
+
         goOnPresence(
                 this,
                 nick,
+                (char *) jid.c_str(),
+                (char *) occupant.c_str(),
+                (char *) newNick.c_str(),
                 self,
                 int(presence.presence()), 
                 int(participant.affiliation),
@@ -219,8 +478,43 @@ class Bot : public ConnectionListener, MUCRoomHandler, LogHandler, EventHandler
     }
 
   private:
+    Tag* pubsub_item(const std::string& node, const std::string& id, Tag *payload) {
+        auto pubsub = new Tag("pubsub");
+        pubsub->setXmlns(XMLNS_PUBSUB);
+
+        auto publish = new Tag(pubsub, "publish");
+        publish->addAttribute("node", node);
+
+        auto item = new Tag(publish, "item");
+        item->addAttribute("id", id);
+        item->addChild(payload);
+
+        return pubsub;
+    }
+
+    void send_raw(Tag *payload, IqContext context) {
+        IQ iq(IQ::Set, JID(), j->getID());
+        iq.addExtension(new RawExtension(payload));
+
+        if (context == ContextProfile) {
+            m_profile_pending++;
+        }
+
+        j->send(iq, this, context);
+    }
+
     JID *jid;
     JID *muc_jid;
     Client *j;
     MUCRoom *m_room;
+    Adhoc *m_adhoc;
+
+    int m_profile_pending; // profile iqs without results yet
+    bool m_profile_failed;
+
+    std::string v_name;
+    std::string v_version;
+    std::string v_os;
+    std::vector<std::string> features;
+    std::map<std::string, Command> commands;
 };
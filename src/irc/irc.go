@@ -0,0 +1,595 @@
+package irc
+
+/*
+	IRC transport. Joins one channel and feeds the same callbacks as glb does,
+	channel operators are reported as admins. User@host is reported as the
+	occupant id; NAMES doesn't have it, so the channel is asked WHO after
+	joining and everyone is reported again with it. Presences are delivered
+	one by one in the order they come, messages in goroutines.
+*/
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"glb"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// max text length in one PRIVMSG, leaves some space for the prefix
+	maxMessageLength = 400
+
+	// servers disconnect clients for excess flood, so lines are sent
+	// in bursts of sendBurst at most, then one per sendInterval
+	sendBurst    = 5
+	sendInterval = time.Second * 2
+
+	// kicked bot comes back after that
+	rejoinDelay = time.Second * 5
+)
+
+// rfc1459 casemapping: {}|^ are lowercase []\~
+var ircLower = strings.NewReplacer("[", "{", "]", "}", "\\", "|", "~", "^")
+
+type (
+	Bot struct {
+		sync.Mutex
+
+		config    *Config
+		cb        interface{}
+		conn      net.Conn
+		nick      string
+		occupants map[string]bool   // nick -> operator
+		hosts     map[string]string // nick -> user@host, reported as occupant id
+		done      chan bool
+		closeOnce sync.Once
+		throttle  throttle
+	}
+
+	// token bucket for the lines sent
+	throttle struct {
+		sync.Mutex
+		tokens int
+		last   time.Time // when tokens were counted
+	}
+
+	Config struct {
+		Server   string // host:port
+		TLS      bool
+		SkipTLS  bool   `yaml:"skip_tls"`
+		Password string // server password
+		Channel  string
+		Nickname string
+		RealName string        `yaml:"real_name"`
+		Timeout  time.Duration // disconnect if server is silent for that long
+	}
+
+	// parsed IRC line
+	message struct {
+		prefix  string
+		command string
+		params  []string
+	}
+)
+
+func New(cb interface{}) *Bot {
+	return &Bot{
+		cb:        cb,
+		occupants: make(map[string]bool),
+		hosts:     make(map[string]string),
+		done:      make(chan bool, 1),
+	}
+}
+
+func parse(line string) *message {
+
+	var msg message
+
+	if strings.HasPrefix(line, ":") {
+		tokens := strings.SplitN(line[1:], " ", 2)
+		msg.prefix = tokens[0]
+		if len(tokens) < 2 {
+			return &msg
+		}
+		line = tokens[1]
+	}
+
+	// trailing param goes after " :"
+	var trailing *string
+	if i := strings.Index(line, " :"); i >= 0 {
+		rest := line[i+2:]
+		trailing = &rest
+		line = line[:i]
+	}
+
+	tokens := strings.Fields(line)
+	if len(tokens) > 0 {
+		msg.command = strings.ToUpper(tokens[0])
+		msg.params = tokens[1:]
+	}
+
+	if trailing != nil {
+		msg.params = append(msg.params, *trailing)
+	}
+
+	return &msg
+}
+
+// nick!user@host -> nick
+func (m *message) nick() string {
+	return strings.SplitN(m.prefix, "!", 2)[0]
+}
+
+// nick!user@host -> user@host
+func (m *message) host() string {
+	if tokens := strings.SplitN(m.prefix, "!", 2); len(tokens) == 2 {
+		return tokens[1]
+	}
+	return ""
+}
+
+func (m *message) param(i int) string {
+	if i < len(m.params) {
+		return m.params[i]
+	}
+	return ""
+}
+
+func (b *Bot) Connect(config *Config) {
+
+	if config.Timeout == 0 {
+		config.Timeout = time.Minute * 5
+	}
+
+	if config.RealName == "" {
+		config.RealName = config.Nickname
+	}
+
+	b.config = config
+	b.nick = config.Nickname
+
+	go func() {
+		err := b.run()
+
+		if cb, ok := b.cb.(glb.OnDisconnect); ok {
+			cb.OnDisconnect(err)
+		}
+
+		b.done <- true
+	}()
+}
+
+func (b *Bot) run() error {
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	if b.config.TLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: b.config.Timeout}, "tcp", b.config.Server, &tls.Config{
+			InsecureSkipVerify: b.config.SkipTLS,
+		})
+	} else {
+		conn, err = net.DialTimeout("tcp", b.config.Server, b.config.Timeout)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	b.conn = conn
+	b.Unlock()
+
+	defer b.close()
+
+	if b.config.Password != "" {
+		b.write("PASS %v", b.config.Password)
+	}
+	b.write("NICK %v", b.config.Nickname)
+	b.write("USER %v 0 * :%v", b.config.Nickname, b.config.RealName)
+
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(b.config.Timeout))
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if b.closed() {
+				return nil // that was us
+			}
+			return err
+		}
+
+		b.handle(parse(strings.TrimRight(line, "\r\n")))
+	}
+}
+
+func (b *Bot) handle(msg *message) {
+
+	if host := msg.host(); host != "" {
+		b.Lock()
+		b.hosts[msg.nick()] = host
+		b.Unlock()
+	}
+
+	switch msg.command {
+	case "PING":
+		b.writeNow("PONG :%v", msg.param(0))
+
+	case "001": // welcome
+		b.write("JOIN %v", b.config.Channel)
+		if cb, ok := b.cb.(glb.OnConnect); ok {
+			go cb.OnConnect()
+		}
+
+	case "433": // nickname is already in use
+		b.Lock()
+		b.nick += "_"
+		nick := b.nick
+		b.Unlock()
+
+		b.write("NICK %v", nick)
+
+	case "353": // names list
+		if !b.isChannel(msg.param(2)) {
+			return
+		}
+		for _, name := range strings.Fields(msg.param(3)) {
+			op := strings.HasPrefix(name, "@") || strings.HasPrefix(name, "~") || strings.HasPrefix(name, "&")
+			b.presence(strings.TrimLeft(name, "~&@%+"), true, op)
+		}
+
+	case "332": // topic on join
+		if b.isChannel(msg.param(1)) {
+			b.subject("", msg.param(2))
+		}
+
+	case "TOPIC":
+		if b.isChannel(msg.param(0)) {
+			b.subject(msg.nick(), msg.param(1))
+		}
+
+	case "JOIN":
+		if !b.isChannel(msg.param(0)) {
+			return
+		}
+
+		b.presence(msg.nick(), true, false)
+
+		if equalNicks(msg.nick(), b.Nickname()) {
+			b.write("WHO %v", b.config.Channel)
+		}
+
+	case "352": // who reply: me channel user host server nick flags :hops name
+		if !b.isChannel(msg.param(1)) {
+			return
+		}
+
+		var (
+			nick  = msg.param(5)
+			flags = msg.param(6)
+		)
+
+		b.Lock()
+		_, online := b.occupants[nick]
+		if online {
+			b.hosts[nick] = msg.param(2) + "@" + msg.param(3)
+		}
+		b.Unlock()
+
+		if online {
+			b.presence(nick, true, strings.ContainsAny(flags, "~&@"))
+		}
+
+	case "PART":
+		if b.isChannel(msg.param(0)) {
+			b.presence(msg.nick(), false, false)
+		}
+
+	case "KICK":
+		if !b.isChannel(msg.param(0)) {
+			return
+		}
+
+		b.presence(msg.param(1), false, false)
+
+		if equalNicks(msg.param(1), b.Nickname()) {
+			log.Printf("Kicked from %v by %v: %v", msg.param(0), msg.nick(), msg.param(2))
+			go b.rejoin()
+		}
+
+	case "QUIT":
+		b.presence(msg.nick(), false, false)
+
+	case "NICK":
+		var (
+			from = msg.nick()
+			to   = msg.param(0)
+		)
+
+		b.Lock()
+		op := b.occupants[from]
+		if equalNicks(from, b.nick) {
+			b.nick = to
+		}
+		b.hosts[to] = b.hosts[from]
+		b.Unlock()
+
+		b.emit(from, false, false, to)
+		b.presence(to, true, op)
+
+	case "MODE":
+		if b.isChannel(msg.param(0)) && len(msg.params) > 1 {
+			b.mode(msg.params[1], msg.params[2:])
+		}
+
+	case "PRIVMSG":
+		var (
+			target  = msg.param(0)
+			private = !b.isChannel(target)
+		)
+
+		if private && !equalNicks(target, b.Nickname()) {
+			return
+		}
+
+		if cb, ok := b.cb.(glb.OnMUCMessage); ok {
+			go cb.OnMUCMessage(&glb.MUCMessage{
+				Body:    msg.param(1),
+				From:    msg.nick(),
+				Private: private,
+			})
+		}
+
+	case "ERROR":
+		log.Printf("IRC error: %v", msg.param(0))
+	}
+}
+
+// +o-o nick1 nick2
+func (b *Bot) mode(modes string, args []string) {
+
+	var (
+		adding = true
+		arg    = 0
+	)
+
+	for _, mode := range modes {
+		switch mode {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		case 'o', 'v', 'h', 'q', 'a', 'b', 'e', 'I', 'k', 'l':
+			if arg >= len(args) || (mode == 'l' && !adding) {
+				continue
+			}
+			if mode == 'o' {
+				b.presence(args[arg], true, adding)
+			}
+			arg++
+		}
+	}
+}
+
+func (b *Bot) isChannel(name string) bool {
+	return equalNicks(name, b.config.Channel)
+}
+
+// equalNicks compares nicks (or channel names) the way servers do
+func equalNicks(a, b string) bool {
+	return ircLower.Replace(strings.ToLower(a)) == ircLower.Replace(strings.ToLower(b))
+}
+
+func (b *Bot) rejoin() {
+	time.Sleep(rejoinDelay)
+	if !b.closed() {
+		b.write("JOIN %v", b.config.Channel)
+	}
+}
+
+func (b *Bot) presence(nick string, online, op bool) {
+	b.emit(nick, online, op, "")
+}
+
+func (b *Bot) emit(nick string, online, op bool, newNick string) {
+
+	if nick == "" {
+		return
+	}
+
+	b.Lock()
+	if online {
+		b.occupants[nick] = op
+	} else {
+		delete(b.occupants, nick)
+	}
+	var (
+		self = nick == b.nick
+		host = b.hosts[nick]
+	)
+	if !online {
+		delete(b.hosts, nick)
+	}
+	b.Unlock()
+
+	var (
+		affiliation = glb.AffiliationNone
+		role        = glb.RoleParticipant
+	)
+
+	// operators look like MUC admins
+	if op {
+		affiliation, role = glb.AffiliationAdmin, glb.RoleModerator
+	}
+
+	if !online {
+		role = glb.RoleNone
+	}
+
+	// right here, so that MODE can't overtake JOIN
+	if cb, ok := b.cb.(glb.OnMUCPresence); ok {
+		cb.OnMUCPresence(&glb.MUCPresence{
+			Nick:        nick,
+			OccupantID:  host,
+			NewNick:     newNick,
+			Online:      online,
+			Admin:       online && op,
+			Self:        self,
+			Affiliation: affiliation,
+			Role:        role,
+		})
+	}
+}
+
+func (b *Bot) subject(from, subject string) {
+	if cb, ok := b.cb.(glb.OnMUCSubject); ok {
+		go cb.OnMUCSubject(from, subject)
+	}
+}
+
+// wait takes a token, waiting for it if there are none
+func (t *throttle) wait() {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	if t.last.IsZero() {
+		t.tokens, t.last = sendBurst, now
+	}
+
+	if earned := int(now.Sub(t.last) / sendInterval); earned > 0 {
+		t.tokens += earned
+		t.last = t.last.Add(sendInterval * time.Duration(earned))
+		if t.tokens >= sendBurst {
+			t.tokens, t.last = sendBurst, now
+		}
+	}
+
+	if t.tokens == 0 {
+		next := t.last.Add(sendInterval)
+		time.Sleep(next.Sub(now))
+		t.tokens, t.last = 1, next
+	}
+
+	t.tokens--
+}
+
+// write sends the line when the throttle allows it
+func (b *Bot) write(format string, args ...interface{}) {
+	b.throttle.wait()
+	b.writeNow(format, args...)
+}
+
+// writeNow sends the line right away, for the ones servers are waiting for
+func (b *Bot) writeNow(format string, args ...interface{}) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.conn == nil {
+		return
+	}
+
+	// no way to smuggle another command in
+	line := strings.NewReplacer("\r", " ", "\n", " ").Replace(fmt.Sprintf(format, args...))
+	if _, err := fmt.Fprintf(b.conn, "%v\r\n", line); err != nil {
+		log.Printf("IRC write failed: %v", err)
+	}
+}
+
+func (b *Bot) close() {
+	b.closeOnce.Do(func() {
+		b.Lock()
+		defer b.Unlock()
+
+		if b.conn != nil {
+			b.conn.Close()
+		}
+		b.conn = nil
+	})
+}
+
+func (b *Bot) closed() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.conn == nil
+}
+
+// splits text into lines short enough for a single PRIVMSG
+func split(text string) []string {
+
+	var result []string
+
+	for _, line := range strings.Split(text, "\n") {
+		for len(line) > maxMessageLength {
+			cut := maxMessageLength
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				// no rune start at all, so it's not UTF-8 anyway
+				cut = maxMessageLength
+			}
+			result = append(result, line[:cut])
+			line = line[cut:]
+		}
+
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+
+	return result
+}
+
+func (b *Bot) Free() {}
+
+func (b *Bot) Disconnect() {
+	b.Leave("bye")
+}
+
+// Leave quits with goodbye as the reason
+func (b *Bot) Leave(goodbye string) {
+	b.writeNow("QUIT :%v", goodbye)
+	b.close()
+}
+
+func (b *Bot) Wait() {
+	<-b.done
+}
+
+func (b *Bot) Nickname() string {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.nick
+}
+
+func (b *Bot) Send(message string) {
+	for _, line := range split(message) {
+		b.write("PRIVMSG %v :%v", b.config.Channel, line)
+	}
+}
+
+func (b *Bot) SendPrivate(message, recipient string) {
+	for _, line := range split(message) {
+		b.write("PRIVMSG %v :%v", recipient, line)
+	}
+}
+
+func (b *Bot) Kick(who, forWhat string) {
+	b.write("KICK %v %v :%v", b.config.Channel, who, forWhat)
+}
+
+func (b *Bot) SetSubject(subject string) {
+	b.write("TOPIC %v :%v", b.config.Channel, subject)
+}
@@ -0,0 +1,252 @@
+package irc
+
+import (
+	"bufio"
+	"glb"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// recorder collects what the transport reports
+type recorder struct {
+	presences chan *glb.MUCPresence
+	messages  chan *glb.MUCMessage
+	connected chan bool
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		presences: make(chan *glb.MUCPresence, 16),
+		messages:  make(chan *glb.MUCMessage, 16),
+		connected: make(chan bool, 1),
+	}
+}
+
+func (r *recorder) OnMUCPresence(p *glb.MUCPresence) { r.presences <- p }
+func (r *recorder) OnMUCMessage(m *glb.MUCMessage)   { r.messages <- m }
+func (r *recorder) OnConnect()                       { r.connected <- true }
+
+func TestParse(t *testing.T) {
+
+	tests := []struct {
+		line    string
+		prefix  string
+		command string
+		params  []string
+	}{
+		{"PING :irc.example.org", "", "PING", []string{"irc.example.org"}},
+		{":nick!user@host PRIVMSG #chan :hello: world", "nick!user@host", "PRIVMSG", []string{"#chan", "hello: world"}},
+		{":srv 353 bot = #chan :@op +voice user", "srv", "353", []string{"bot", "=", "#chan", "@op +voice user"}},
+		{":nick!user@host join #chan", "nick!user@host", "JOIN", []string{"#chan"}},
+		{":srv", "srv", "", nil},
+		{"", "", "", nil},
+	}
+
+	for _, test := range tests {
+		msg := parse(test.line)
+		if msg.prefix != test.prefix || msg.command != test.command || !reflect.DeepEqual(msg.params, test.params) {
+			t.Errorf("parse(%q) = %q %q %q", test.line, msg.prefix, msg.command, msg.params)
+		}
+	}
+
+	msg := parse(":nick!user@host QUIT")
+	if msg.nick() != "nick" || msg.host() != "user@host" || msg.param(5) != "" {
+		t.Errorf("nick %q, host %q", msg.nick(), msg.host())
+	}
+}
+
+func TestMode(t *testing.T) {
+
+	var (
+		r = newRecorder()
+		b = New(r)
+	)
+
+	b.config = &Config{Channel: "#chan"}
+
+	// +l takes an argument, -l doesn't, +v doesn't change op status
+	b.mode("+lo-l+v-o", []string{"10", "alice", "bob", "carol"})
+
+	want := map[string]bool{"alice": true, "carol": false}
+	for range want {
+		p := <-r.presences
+		if op, found := want[p.Nick]; !found || p.Admin != op {
+			t.Errorf("unexpected presence %+v", p)
+		}
+	}
+
+	select {
+	case p := <-r.presences:
+		t.Errorf("unexpected presence %+v", p)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestSplit(t *testing.T) {
+
+	long := strings.Repeat("ж", maxMessageLength) // two bytes each
+
+	tests := []struct {
+		text  string
+		lines int
+	}{
+		{"", 0},
+		{"one", 1},
+		{"one\n\ntwo\n", 2},
+		{long, 2},
+	}
+
+	for _, test := range tests {
+		lines := split(test.text)
+		if len(lines) != test.lines {
+			t.Errorf("split(%.20q) = %v lines", test.text, len(lines))
+		}
+		for _, line := range lines {
+			if len(line) > maxMessageLength || !utf8.ValidString(line) {
+				t.Errorf("bad line %.20q of %v bytes", line, len(line))
+			}
+		}
+	}
+
+	if strings.Join(split(long), "") != long {
+		t.Errorf("split lost something")
+	}
+
+	// continuation bytes only, there is nowhere to cut nicely
+	garbage := strings.Repeat("\x80", maxMessageLength*2+1)
+	lines := split(garbage)
+	if len(lines) != 3 || strings.Join(lines, "") != garbage {
+		t.Errorf("split of invalid UTF-8 gave %v lines", len(lines))
+	}
+}
+
+func TestEqualNicks(t *testing.T) {
+	if !equalNicks("Bot[x]", "bot{X}") || !equalNicks("a\\b~", "A|B^") || equalNicks("bot", "bot_") {
+		t.Errorf("casemapping is wrong")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+
+	var (
+		th      throttle
+		started = time.Now()
+	)
+
+	for i := 0; i < sendBurst; i++ {
+		th.wait()
+	}
+
+	if took := time.Since(started); took > sendInterval/2 {
+		t.Errorf("burst took %v", took)
+	}
+
+	th.wait()
+	if took := time.Since(started); took < sendInterval*9/10 {
+		t.Errorf("line after the burst was sent after %v", took)
+	}
+}
+
+// minimal in-process server
+func TestSession(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var (
+		r = newRecorder()
+		b = New(r)
+	)
+
+	b.Connect(&Config{
+		Server:   listener.Addr().String(),
+		Channel:  "#chan",
+		Nickname: "bot",
+		Timeout:  time.Second * 5,
+	})
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	lines := bufio.NewReader(conn)
+	expect := func(want string) {
+		conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected %q: %v", want, err)
+		}
+		if line = strings.TrimRight(line, "\r\n"); line != want {
+			t.Fatalf("expected %q, got %q", want, line)
+		}
+	}
+	send := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	expect("NICK bot")
+	expect("USER bot 0 * :bot")
+
+	send(":srv 001 bot :welcome")
+	expect("JOIN #chan")
+	<-r.connected
+
+	// NAMES has no hosts, WHO has, presences come in order
+	send(":bot!b@here JOIN #chan")
+	expect("WHO #chan")
+	send(":srv 353 bot = #chan :@Alice bob")
+	send(":srv 352 bot #chan a host srv Alice H@ :0 Alice")
+	send(":srv 352 bot #chan g gone srv ghost H :0 ghost")
+
+	for _, want := range []glb.MUCPresence{
+		{Nick: "bot", OccupantID: "b@here"},
+		{Nick: "Alice", Admin: true},
+		{Nick: "bob"},
+		{Nick: "Alice", OccupantID: "a@host", Admin: true},
+	} {
+		p := <-r.presences
+		if p.Nick != want.Nick || p.OccupantID != want.OccupantID || p.Admin != want.Admin || !p.Online {
+			t.Errorf("expected %+v, got %+v", want, *p)
+		}
+	}
+
+	send("PING :123")
+	expect("PONG :123")
+
+	send(":Alice!a@host PRIVMSG BOT :psst")
+	send(":Alice!a@host PRIVMSG somebody :not for us")
+	send(":Alice!a@host PRIVMSG #Chan :hi all")
+
+	// callbacks are run in goroutines, so the order is not known
+	want := map[glb.MUCMessage]bool{
+		{Body: "psst", From: "Alice", Private: true}: true,
+		{Body: "hi all", From: "Alice"}:              true,
+	}
+	for range want {
+		if msg := <-r.messages; !want[*msg] {
+			t.Errorf("unexpected message %+v", *msg)
+		}
+	}
+
+	b.SendPrivate("secret", "Alice")
+	expect("PRIVMSG Alice :secret")
+
+	b.Leave("bye")
+	expect("QUIT :bye")
+	b.Wait()
+
+	select {
+	case p := <-r.presences:
+		t.Errorf("unexpected presence %+v", *p)
+	default:
+	}
+}
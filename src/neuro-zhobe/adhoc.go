@@ -0,0 +1,164 @@
+package main
+
+/*
+	Service discovery, software version and XEP-0050 ad-hoc commands.
+	Every builtin command and plugin is exposed as an ad-hoc command, so
+	clients like Gajim are able to run them from a menu.
+*/
+
+import (
+	"fmt"
+	"glb"
+	"log"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const mucNamespace = "http://jabber.org/protocol/muc"
+
+// set it with -ldflags "-X main.version=..."
+var version = "dev"
+
+// announce must be called before connecting, plugins are kept
+// up to date by announcePlugins after that
+func (z *NeuroZhobe) announce(bot *glb.GBot) {
+
+	bot.SetVersion(
+		"neuro-zhobe",
+		fmt.Sprintf("%v (up since %v)", version, startupTime.Format(time.RFC3339)),
+		runtime.GOOS,
+	)
+
+	bot.AddFeature(mucNamespace)
+
+	for _, cmd := range builtinCommands() {
+		z.addCommand(bot, cmd)
+	}
+
+	z.adhoc.Lock()
+	z.adhoc.bot = bot
+	z.adhoc.plugins = nil
+	z.adhoc.Unlock()
+
+	z.announcePlugins()
+}
+
+// forgetAnnounced must be called before the bot is freed
+func (z *NeuroZhobe) forgetAnnounced() {
+	z.adhoc.Lock()
+	defer z.adhoc.Unlock()
+
+	z.adhoc.bot = nil
+	z.adhoc.plugins = nil
+}
+
+// announcePlugins exposes the indexed plugins and hides the ones gone
+func (z *NeuroZhobe) announcePlugins() {
+	a := &z.adhoc
+	a.Lock()
+	defer a.Unlock()
+
+	if a.bot == nil {
+		return // not xmpp, not announced yet or freed
+	}
+
+	plugins := map[string]bool{}
+	for _, cmd := range z.pluginCommands() {
+		z.addCommand(a.bot, cmd) // usage may be changed
+		plugins[cmd.name] = true
+	}
+
+	for name := range a.plugins {
+		if !plugins[name] {
+			a.bot.RemoveCommand(name)
+		}
+	}
+
+	a.plugins = plugins
+}
+
+func (z *NeuroZhobe) addCommand(bot *glb.GBot, cmd *command) {
+	usage := "Arguments"
+	if cmd.usageString() != "" {
+		usage = cmd.usageString()
+	}
+	bot.AddCommand(cmd.name, z.prefix()+cmd.name, usage)
+}
+
+// OnAdhocAccess lets in room occupants and JIDs with a role, what they
+// are allowed to run is decided by the commands
+func (z *NeuroZhobe) OnAdhocAccess(from string) bool {
+
+	if occupant := z.config().Jabber.Conference + "/"; strings.HasPrefix(from, occupant) {
+		return z.room.isOnline(from[len(occupant):])
+	}
+
+	var (
+		jid      = strings.SplitN(from, "/", 2)[0]
+		identity = identityJID + ":" + jid
+	)
+
+	if _, found := z.config().Roles.JIDs[jid]; found {
+		return true
+	}
+
+	if z.assignedRole(identity) != "" {
+		return true
+	}
+
+	if !z.room.isPresent(identity) {
+		log.Printf("Ad-hoc commands denied to %v: not in the room", from)
+		return false
+	}
+
+	return true
+}
+
+func (z *NeuroZhobe) OnAdhocCommand(cmd *glb.AdhocCommand) {
+
+	if !z.begin() {
+		return // shutting down
+	}
+	defer z.end()
+
+	// room occupants are known by their nicks, the others by their JIDs
+	var from, jid = cmd.From, strings.SplitN(cmd.From, "/", 2)[0]
+	if occupant := z.config().Jabber.Conference + "/"; strings.HasPrefix(from, occupant) {
+		from, jid = from[len(occupant):], ""
+	}
+
+	log.Printf("%v (ad-hoc): %v %v", cmd.From, cmd.Node, cmd.Args)
+
+	var (
+		msg = &glb.MUCMessage{
+			Body:    strings.TrimSpace(z.prefix() + cmd.Node + " " + cmd.Args),
+			From:    from,
+			JID:     jid,
+			Private: true,
+		}
+		output []string
+	)
+
+	redirectsSync.Lock()
+	redirects[msg] = func(text string) {
+		output = append(output, text)
+	}
+	redirectsSync.Unlock()
+
+	// errors are reported by middlewares as usual
+	_, err := z.wrap(messageHandler{name: "commands", cb: commandHandler})(z, msg)
+
+	redirectsSync.Lock()
+	delete(redirects, msg)
+	redirectsSync.Unlock()
+
+	if err != nil {
+		log.Printf("Ad-hoc command %v failed: %v", cmd.Node, err)
+		output = append(output, "542 SHIT HAPPEND")
+	}
+
+	if bot, ok := z.bot.(*glb.GBot); ok {
+		bot.RespondCommand(cmd, strings.Join(output, "\n"))
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+/*
+	Argument parser shared by builtin commands and plugins.
+
+	Arguments are separated by whitespace. "Double quotes" allow \ escapes,
+	'single quotes' are taken literally, and a backslash outside of quotes
+	escapes the next character. Single quotes only start at the beginning of
+	an argument, so apostrophes (Martha's) are just letters. --flag=value and
+	--flag are options, a lone -- ends them.
+
+	Plugins get the arguments split on whitespace if they can't be parsed.
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type (
+	argKind uint
+
+	// positional argument declared by a command
+	param struct {
+		name     string
+		kind     argKind
+		optional bool
+		rest     bool // takes all the remaining arguments
+	}
+
+	arguments struct {
+		raw        string   // as typed, after the command
+		tokens     []string // all the arguments including options
+		positional []string
+		flags      map[string]string
+		values     map[string]interface{} // bound positional arguments
+	}
+)
+
+const (
+	argString = argKind(iota)
+	argInt
+	argDuration
+)
+
+func tokenize(s string) ([]string, error) {
+
+	var (
+		result  []string
+		current strings.Builder
+		inToken bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				current.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inToken = true, true
+		case r == '"' || r == '\'' && !inToken:
+			quote, inToken = r, true
+		case unicode.IsSpace(r):
+			if inToken {
+				result = append(result, current.String())
+				current.Reset()
+				inToken = false
+			}
+		default:
+			current.WriteRune(r)
+			inToken = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+
+	if escaped {
+		return nil, fmt.Errorf("nothing to escape at the end")
+	}
+
+	if inToken {
+		result = append(result, current.String())
+	}
+
+	return result, nil
+}
+
+func parseArguments(raw string) (*arguments, error) {
+
+	tokens, err := tokenize(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		result = &arguments{
+			raw:    raw,
+			tokens: tokens,
+			flags:  map[string]string{},
+			values: map[string]interface{}{},
+		}
+		options = true
+	)
+
+	for _, token := range tokens {
+		switch {
+		case options && token == "--":
+			options = false
+		case options && strings.HasPrefix(token, "--") && len(token) > 2:
+			kv := strings.SplitN(token[2:], "=", 2)
+			if len(kv) == 2 {
+				result.flags[kv[0]] = kv[1]
+			} else {
+				result.flags[kv[0]] = ""
+			}
+		default:
+			result.positional = append(result.positional, token)
+		}
+	}
+
+	return result, nil
+}
+
+// plainArguments splits raw on whitespace, for the ones parseArguments fails on
+func plainArguments(raw string) *arguments {
+	tokens := strings.Fields(raw)
+	return &arguments{
+		raw:        raw,
+		tokens:     tokens,
+		positional: tokens,
+		flags:      map[string]string{},
+		values:     map[string]interface{}{},
+	}
+}
+
+// bind checks positional arguments against declared params
+func (a *arguments) bind(params []param) error {
+
+	for i, p := range params {
+
+		if i >= len(a.positional) {
+			if !p.optional && !p.rest {
+				return fmt.Errorf("%v is required", p.name)
+			}
+			continue
+		}
+
+		value := a.positional[i]
+		if p.rest {
+			value = strings.Join(a.positional[i:], " ")
+		}
+
+		switch p.kind {
+		case argInt:
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%v must be a number", p.name)
+			}
+			a.values[p.name] = v
+		case argDuration:
+			v, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%v must be a duration like 5m", p.name)
+			}
+			a.values[p.name] = v
+		default:
+			a.values[p.name] = value
+		}
+	}
+
+	if len(params) == 0 || params[len(params)-1].rest || len(a.positional) <= len(params) {
+		return nil
+	}
+
+	return fmt.Errorf("too many arguments")
+}
+
+func (a *arguments) String(name string) string {
+	v, _ := a.values[name].(string)
+	return v
+}
+
+func (a *arguments) Int(name string) int {
+	v, _ := a.values[name].(int)
+	return v
+}
+
+func (a *arguments) Duration(name string) time.Duration {
+	v, _ := a.values[name].(time.Duration)
+	return v
+}
+
+func (a *arguments) Flag(name string) (string, bool) {
+	v, found := a.flags[name]
+	return v, found
+}
+
+// <required> [optional] [rest...]
+func usage(params []param) string {
+
+	var result []string
+	for _, p := range params {
+		name := p.name
+		if p.rest {
+			name += "..."
+		}
+
+		if p.optional || p.rest {
+			result = append(result, fmt.Sprintf("[%v]", name))
+		} else {
+			result = append(result, fmt.Sprintf("<%v>", name))
+		}
+	}
+
+	return strings.Join(result, " ")
+}
@@ -8,6 +8,7 @@ import (
 
 func init() {
 	msgHandlers = append(msgHandlers, messageHandler{
+		name:     "call",
 		cb:       callHandler,
 		priority: 100,
 	})
@@ -21,15 +22,15 @@ func callHandler(z *NeuroZhobe, msg *glb.MUCMessage) (bool, error) {
 	if found := z.CallRegexp().FindStringIndex(msg.Body); len(found) >= 2 {
 		var (
 			messageBody = msg.Body[found[1]:]
-			isAdmin     = fmt.Sprintf("%v", z.admins[msg.From])
+			isAdmin     = fmt.Sprintf("%v", z.senderRole(msg) >= roleOperator)
 		)
 
-		answer, err := z.execute("./chat/answer", msg.From, isAdmin, messageBody)
+		answer, err := z.execute("./chat/answer", runOptions{}, msg.From, isAdmin, messageBody)
 		if err != nil {
 			return true, err
 		}
 
-		z.bot.Send(answer)
+		z.reply(msg, answer)
 		return true, nil
 	}
 
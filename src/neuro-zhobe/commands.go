@@ -7,118 +7,238 @@ package main
 import (
 	"fmt"
 	"glb"
-	"io/ioutil"
-	"os"
-	"os/exec"
 	"path"
-	"regexp"
+	"sort"
 	"strings"
 )
 
-type cmdHandler func(z *NeuroZhobe, msg *glb.MUCMessage, params string) error
+type (
+	cmdHandler func(z *NeuroZhobe, msg *glb.MUCMessage, args *arguments) error
+
+	// builtin command with its metadata
+	command struct {
+		name        string
+		aliases     []string
+		description string // short, one line
+		usage       string // generated from params if empty
+		params      []param
+		role        role // required to run it
+		hidden      bool // not listed in !help
+		handler     cmdHandler
+	}
+)
 
-const commandPrefix = "!"
+const defaultPrefix = "!"
 
 var (
-	commandRegexp = regexp.MustCompile(fmt.Sprintf("^%v[^ ]+", regexp.QuoteMeta(commandPrefix)))
-	stripRegexp   = regexp.MustCompile("(`|\\$|\\.\\.)")
-	quoteRegexp   = regexp.MustCompile("(\"|')")
-
-	commands = map[string]cmdHandler{}
+	// by name and by all the aliases
+	commands = map[string]*command{}
 )
 
 func init() {
 	msgHandlers = append(msgHandlers, messageHandler{
-		priority: 100,
+		name:     "commands",
+		priority: 110, // before callHandler, since commands can be addressed to the bot
 		cb:       commandHandler,
 	})
 }
 
-func strip(s string) string {
-	return quoteRegexp.ReplaceAllString(stripRegexp.ReplaceAllString(s, ""), "“")
+func registerCommand(cmd *command) {
+	for _, name := range append([]string{cmd.name}, cmd.aliases...) {
+		if _, exists := commands[name]; exists {
+			panic(fmt.Sprintf("command %v is already registered", name))
+		}
+		commands[name] = cmd
+	}
 }
 
-func commandHandler(z *NeuroZhobe, msg *glb.MUCMessage) (bool, error) {
+// visible builtin commands, sorted by name
+func builtinCommands() []*command {
 
-	// check for command regexp
-	if !commandRegexp.MatchString(msg.Body) {
-		return false, nil
+	var result []*command
+	for name, cmd := range commands {
+		if name == cmd.name && !cmd.hidden {
+			result = append(result, cmd)
+		}
 	}
 
-	// split command message into parts
-	var (
-		tokens  = strings.SplitN(msg.Body, " ", 2)
-		command string
-		params  string
-	)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].name < result[j].name
+	})
+
+	return result
+}
+
+// plugin names, sorted
+func (z *NeuroZhobe) plugins() []string {
+	return z.index.names()
+}
+
+func (z *NeuroZhobe) prefixes() []string {
+	if len(z.config().Prefixes) == 0 {
+		return []string{defaultPrefix}
+	}
+	return z.config().Prefixes
+}
+
+// the one used in help texts
+func (z *NeuroZhobe) prefix() string {
+	return z.prefixes()[0]
+}
+
+func (z *NeuroZhobe) commandExists(name string) bool {
+	if _, builtin := commands[name]; builtin {
+		return true
+	}
+
+	_, found := z.findPlugin(name)
+	return found
+}
+
+// parseCommand recognizes "!command params" (with any of the prefixes)
+// and "BotNick: command params" (only for existing commands)
+func (z *NeuroZhobe) parseCommand(body string) (command, params string, ok bool) {
 
-	if len(tokens) > 0 && len(tokens[0]) > 0 {
-		command = tokens[0][1:] // command without a prefix (!>help< coco)
+	var rest string
+
+	for _, prefix := range z.prefixes() {
+		if strings.HasPrefix(body, prefix) {
+			rest, ok = body[len(prefix):], true
+			break
+		}
+	}
+
+	if !ok {
+		found := z.CallRegexp().FindStringIndex(body)
+		if len(found) < 2 {
+			return "", "", false
+		}
+		rest = body[found[1]:]
 	}
 
+	// split command message into parts
+	tokens := strings.SplitN(rest, " ", 2)
+	command = tokens[0] // command without a prefix (!>help< coco)
+
 	if len(tokens) > 1 {
 		params = tokens[1] // params  (!help >cococo coco co<)
 	}
 
-	handler, builtin := commands[command]
-	if builtin && handler != nil {
-		return true, handler(z, msg, params)
+	if command == "" {
+		return "", "", false
 	}
 
-	search := path.Join(z.config.Root, "./plugins/", path.Base(command))
-	// check if file exists
-	if _, err := os.Stat(search); os.IsNotExist(err) {
-		return true, PublicError(fmt.Errorf("%v: WAT", msg.From))
+	// addressed messages are mostly meant for chat
+	if !ok && !z.commandExists(command) {
+		return "", "", false
 	}
 
-	// execute plugin file
-	result, err := z.executePlugin(search, msg.From, params, z.admins[msg.From])
-	if result > "" {
-		z.bot.Send(result)
+	return command, params, true
+}
+
+func (cmd *command) usageString() string {
+	if cmd.usage != "" {
+		return cmd.usage
+	}
+	return usage(cmd.params)
+}
+
+func commandHandler(z *NeuroZhobe, msg *glb.MUCMessage) (bool, error) {
+
+	command, params, ok := z.parseCommand(msg.Body)
+	if !ok {
+		return false, nil
 	}
+
+	args, parseErr := parseArguments(params)
+
+	cmd, builtin := commands[command]
+	if builtin && cmd.handler != nil {
+		if z.senderRole(msg) < cmd.role {
+			return true, PublicError(fmt.Errorf("GTFO"))
+		}
+		if parseErr != nil {
+			return true, PublicError(parseErr)
+		}
+		if err := args.bind(cmd.params); err != nil {
+			return true, PublicError(fmt.Errorf("%v; usage: %v%v %v", err, z.prefix(), cmd.name, cmd.usageString()))
+		}
+		return true, cmd.handler(z, msg, args)
+	}
+
+	name, found := z.findPlugin(command)
+	if !found {
+		if z.config().SilentUnknown {
+			return true, nil
+		}
+		if suggestion := z.suggestCommand(command); suggestion != "" {
+			return true, PublicError(fmt.Errorf("%v: WAT. Did you mean %v%v?", msg.From, z.prefix(), suggestion))
+		}
+		return true, PublicError(fmt.Errorf("%v: WAT", msg.From))
+	}
+
+	required, err := z.pluginRole(name)
 	if err != nil {
 		return true, err
 	}
 
-	return true, nil
-}
+	if z.senderRole(msg) < required {
+		return true, PublicError(fmt.Errorf("GTFO"))
+	}
 
-// return values: stdout, true if path binary/script is found, err if any
-func (z *NeuroZhobe) executePlugin(path, from, args string, isAdmin bool) (string, error) {
+	if parseErr != nil {
+		args = plainArguments(params)
+	}
 
-	return z.execute(path, from, fmt.Sprintf("%v", isAdmin), args)
+	return true, z.runPlugin(msg, name, args)
 }
 
-func (z *NeuroZhobe) execute(path string, args ...string) (string, error) {
-	// exec and get output
+// runPlugin executes the plugin and sends the result
+func (z *NeuroZhobe) runPlugin(msg *glb.MUCMessage, name string, args *arguments) error {
+
+	var (
+		file = path.Join(z.pluginsDir(), name)
+		j    = z.jobs.start(name, z.senderIdentity(msg))
+	)
+	defer z.jobs.finish(j)
 
-	filteredArgs := make([]string, len(args))
-	for i, arg := range args {
-		filteredArgs[i] = strip(arg)
+	switch z.pluginProtocol(name) {
+	case protocolJSON:
+		return z.executeJSONPlugin(file, msg, name, args, j)
+	case protocolStream:
+		return z.executeStreamingPlugin(file, msg, args, j)
 	}
 
-	cmd := exec.Command(path, filteredArgs...)
+	// execute plugin file
+	result, err := z.executePlugin(file, msg, args.tokens, runOptions{job: j})
+	if result > "" {
+		z.reply(msg, result)
+	}
 
-	stdout, _ := cmd.StdoutPipe()
-	stderr, _ := cmd.StderrPipe()
+	return err
+}
 
-	if err := cmd.Start(); err != nil {
-		return "", err
-	}
+// plugins get: sender, "true" if sender is an operator, arguments one by one
+// (see jsonplugin.go for the other protocol)
+func (z *NeuroZhobe) executePlugin(plugin string, msg *glb.MUCMessage, args []string, opts runOptions) (string, error) {
 
-	out, _ := ioutil.ReadAll(stdout)
-	outerr, _ := ioutil.ReadAll(stderr)
+	r := z.senderRole(msg)
 
-	err := cmd.Wait()
-	if err != nil {
-		return "", err
-	}
+	env, revoke := z.pluginEnv(plugin, z.senderIdentity(msg), r)
+	defer revoke()
 
-	err = nil
+	isAdmin := fmt.Sprintf("%v", r >= roleOperator)
+	opts.env = env
 
-	if len(outerr) != 0 {
-		err = fmt.Errorf("%s", outerr)
-	}
+	return z.execute(plugin, opts, append([]string{msg.From, isAdmin}, args...)...)
+}
+
+// sender role name is in ZHOBE_ROLE, and identity is in ZHOBE_USER,
+// the store of the plugin is at ZHOBE_STORE (see storehttp.go)
+func (z *NeuroZhobe) pluginEnv(plugin, identity string, r role) ([]string, func()) {
+
+	env := []string{"ZHOBE_ROLE=" + r.String(), "ZHOBE_USER=" + identity}
 
-	return strings.TrimRight(string(out), " \t\n"), err
+	store, revoke := grantStore(z.pluginBucket(path.Base(plugin)))
+	return append(env, store...), revoke
 }
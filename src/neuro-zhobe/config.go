@@ -0,0 +1,435 @@
+package main
+
+/*
+	Config loading:
+
+		- unknown keys are errors, so typos don't go unnoticed
+		- toads inherit everything they don't set from the defaults section,
+		  nested sections and maps are merged, lists are replaced
+		- secrets (passwords, gsend_secret) can be "env:NAME" or "file:/path"
+		- everything is validated before any toad is touched, errors
+		  are reported with their paths: zhobe.ttyh.jabber.jid: required
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type configErrors []string
+
+func (e *configErrors) add(path, format string, args ...interface{}) {
+	*e = append(*e, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (e configErrors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// configPath is the first argument (after check-config, if any)
+func configPath() string {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "check-config" {
+		args = args[1:]
+	}
+
+	if len(args) > 0 {
+		return args[0]
+	}
+	return "./config.yaml"
+}
+
+func readConfig() (*NeuroConfig, error) {
+
+	bytes, err := ioutil.ReadFile(configPath())
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(bytes)
+}
+
+func parseConfig(data []byte) (*NeuroConfig, error) {
+
+	var (
+		raw  map[interface{}]interface{}
+		errs configErrors
+	)
+
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	checkKeys("", raw, reflect.TypeOf(NeuroConfig{}), &errs)
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, errs
+	}
+
+	var result NeuroConfig
+	if err := yaml.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+
+	// toads inherit defaults
+	if result.Defaults != nil {
+		toads, _ := raw["zhobe"].(map[interface{}]interface{})
+		for name, toad := range result.Zhobe {
+			inherit(reflect.ValueOf(&toad).Elem(), reflect.ValueOf(*result.Defaults), toads[name])
+			result.Zhobe[name] = toad
+		}
+	}
+
+	result.resolveSecrets(&errs)
+	result.validate(&errs)
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, errs
+	}
+
+	return &result, nil
+}
+
+// yamlKey is the key yaml uses for the field, empty if it's skipped
+func yamlKey(field reflect.StructField) string {
+	tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	switch {
+	case tag == "-" || field.PkgPath != "":
+		return ""
+	case tag != "":
+		return tag
+	}
+	return strings.ToLower(field.Name)
+}
+
+// checkKeys reports keys of raw which have no field in t
+func checkKeys(path string, raw interface{}, t reflect.Type, errs *configErrors) {
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	join := func(key interface{}) string {
+		if path == "" {
+			return fmt.Sprint(key)
+		}
+		return fmt.Sprintf("%v.%v", path, key)
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		values, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+
+		fields := map[string]reflect.StructField{}
+		for i := 0; i < t.NumField(); i++ {
+			if key := yamlKey(t.Field(i)); key != "" {
+				fields[key] = t.Field(i)
+			}
+		}
+
+		for key, value := range values {
+			field, found := fields[fmt.Sprint(key)]
+			if !found {
+				errs.add(join(key), "unknown key")
+				continue
+			}
+			checkKeys(join(key), value, field.Type, errs)
+		}
+
+	case reflect.Map:
+		values, _ := raw.(map[interface{}]interface{})
+		for key, value := range values {
+			checkKeys(join(key), value, t.Elem(), errs)
+		}
+
+	case reflect.Slice:
+		values, _ := raw.([]interface{})
+		for i, value := range values {
+			checkKeys(join(i), value, t.Elem(), errs)
+		}
+	}
+}
+
+// inherit copies to toad everything which is not set in its raw config
+func inherit(toad, defaults reflect.Value, raw interface{}) {
+
+	switch toad.Kind() {
+	case reflect.Ptr:
+		if defaults.IsNil() {
+			return
+		}
+		if toad.IsNil() {
+			toad.Set(reflect.New(toad.Type().Elem()))
+		}
+		inherit(toad.Elem(), defaults.Elem(), raw)
+
+	case reflect.Struct:
+		values, _ := raw.(map[interface{}]interface{})
+		for i := 0; i < toad.NumField(); i++ {
+			key := yamlKey(toad.Type().Field(i))
+			if key == "" {
+				continue
+			}
+
+			value, set := values[key]
+			switch toad.Field(i).Kind() {
+			case reflect.Ptr, reflect.Struct, reflect.Map:
+				inherit(toad.Field(i), defaults.Field(i), value)
+			default:
+				if !set {
+					toad.Field(i).Set(defaults.Field(i))
+				}
+			}
+		}
+
+	case reflect.Map:
+		if defaults.Len() == 0 {
+			return
+		}
+		if toad.IsNil() {
+			toad.Set(reflect.MakeMap(toad.Type()))
+		}
+		for _, key := range defaults.MapKeys() {
+			if !toad.MapIndex(key).IsValid() {
+				toad.SetMapIndex(key, defaults.MapIndex(key))
+			}
+		}
+	}
+}
+
+// secret resolves "env:NAME" and "file:/path" values
+func secret(value string) (string, error) {
+
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		result, found := os.LookupEnv(name)
+		if !found {
+			return "", fmt.Errorf("environment variable %v is not set", name)
+		}
+		return result, nil
+
+	case strings.HasPrefix(value, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	return value, nil
+}
+
+func (c *NeuroConfig) resolveSecrets(errs *configErrors) {
+
+	resolve := func(path string, value *string) {
+		result, err := secret(*value)
+		if err != nil {
+			errs.add(path, "%v", err)
+			return
+		}
+		*value = result
+	}
+
+	for name, toad := range c.Zhobe {
+		path := "zhobe." + name
+
+		resolve(path+".gsend_secret", &toad.GsendSecret)
+
+		// transport configs are pointers and could be shared, so copy them
+		if toad.Jabber != nil {
+			jabber := *toad.Jabber
+			resolve(path+".jabber.password", &jabber.Password)
+			toad.Jabber = &jabber
+		}
+
+		if toad.IRC != nil {
+			irc := *toad.IRC
+			resolve(path+".irc.password", &irc.Password)
+			toad.IRC = &irc
+		}
+
+		c.Zhobe[name] = toad
+	}
+}
+
+// names which can be disabled
+func knownHandlers() map[string]bool {
+	result := map[string]bool{}
+	for _, h := range msgHandlers {
+		result[h.name] = true
+	}
+	for _, f := range filters {
+		result[f.name] = true
+	}
+	for _, m := range middlewares {
+		result[m.name] = true
+	}
+	for _, f := range replyFilters {
+		result[f.name] = true
+	}
+	return result
+}
+
+func (c *NeuroConfig) validate(errs *configErrors) {
+
+	if len(c.Zhobe) == 0 {
+		errs.add("zhobe", "at least one toad is required")
+	}
+
+	for name, toad := range c.Zhobe {
+		toad.validate("zhobe."+name, errs)
+	}
+
+	for i, relay := range c.Relays {
+		path := fmt.Sprintf("relay.%v", i)
+
+		for key, toad := range map[string]string{"from": relay.From, "to": relay.To} {
+			if _, found := c.Zhobe[toad]; !found {
+				errs.add(path+"."+key, "unknown toad %q", toad)
+			}
+		}
+
+		switch relay.Filter {
+		case "", relayAll, relayCommands, relayMentions:
+		default:
+			errs.add(path+".filter", "must be one of %v, %v, %v", relayAll, relayCommands, relayMentions)
+		}
+
+		if _, err := regexp.Compile(relay.Match); err != nil {
+			errs.add(path+".match", "%v", err)
+		}
+
+		if relay.Rate < 0 {
+			errs.add(path+".rate", "must not be negative")
+		}
+	}
+}
+
+func (c *Config) validate(path string, errs *configErrors) {
+
+	required := func(key, value string) {
+		if value == "" {
+			errs.add(path+"."+key, "required")
+		}
+	}
+
+	required("root", c.Root)
+
+	switch c.Transport {
+	case "", "xmpp":
+		if c.Jabber == nil {
+			errs.add(path+".jabber", "required")
+			break
+		}
+		required("jabber.jid", c.Jabber.JID)
+		required("jabber.password", c.Jabber.Password)
+		required("jabber.conference", c.Jabber.Conference)
+		required("jabber.nickname", c.Jabber.Nickname)
+
+	case "irc":
+		if c.IRC == nil {
+			errs.add(path+".irc", "required")
+			break
+		}
+		required("irc.server", c.IRC.Server)
+		required("irc.channel", c.IRC.Channel)
+		required("irc.nickname", c.IRC.Nickname)
+
+	case "console":
+
+	default:
+		errs.add(path+".transport", "must be xmpp, console or irc")
+	}
+
+	if c.RestartTimeout < 0 {
+		errs.add(path+".restart_timeout", "must not be negative")
+	}
+
+	if c.PluginGrace < 0 {
+		errs.add(path+".plugin_grace", "must not be negative")
+	}
+
+	if c.DaemonHealth < 0 {
+		errs.add(path+".daemon_health", "must not be negative")
+	}
+
+	if c.PluginTimeout < 0 {
+		errs.add(path+".plugin_timeout", "must not be negative")
+	}
+
+	if c.StreamLines < 0 {
+		errs.add(path+".stream_lines", "must not be negative")
+	}
+
+	for plugin, profile := range c.PluginSandbox {
+		if _, found := c.SandboxProfiles[profile]; !found && profile != defaultSandbox {
+			errs.add(path+".plugin_sandbox."+plugin, "unknown sandbox profile %q", profile)
+		}
+	}
+
+	for plugin, protocol := range c.PluginProtocols {
+		if protocol != protocolPlain && protocol != protocolJSON && protocol != protocolStream {
+			errs.add(path+".plugin_protocols."+plugin, "must be %v, %v or %v", protocolPlain, protocolJSON, protocolStream)
+		}
+	}
+
+	for plugin, timeout := range c.PluginTimeouts {
+		if timeout <= 0 {
+			errs.add(path+".plugin_timeouts."+plugin, "must be positive")
+		}
+	}
+
+	for i, prefix := range c.Prefixes {
+		if strings.TrimSpace(prefix) == "" {
+			errs.add(fmt.Sprintf("%v.prefixes.%v", path, i), "must not be empty")
+		}
+	}
+
+	known := knownHandlers()
+	for i, name := range c.Disable {
+		if !known[name] {
+			errs.add(fmt.Sprintf("%v.disable.%v", path, i), "unknown handler %q", name)
+		}
+	}
+
+	checkRoles := func(section string, roles map[string]string) {
+		for key, name := range roles {
+			if _, err := parseRole(name); err != nil {
+				errs.add(fmt.Sprintf("%v.%v.%v", path, section, key), "%v", err)
+			}
+		}
+	}
+
+	checkRoles("roles.jids", c.Roles.JIDs)
+	checkRoles("roles.nicks", c.Roles.Nicks)
+	checkRoles("roles.affiliations", c.Roles.Affiliations)
+	checkRoles("plugin_roles", c.PluginRoles)
+
+	checkLimit := func(key string, limit RateLimit) {
+		if limit.Count < 0 {
+			errs.add(path+".rate_limits."+key+".count", "must not be negative")
+		}
+		if limit.Count > 0 && limit.Per <= 0 {
+			errs.add(path+".rate_limits."+key+".per", "required")
+		}
+	}
+
+	checkLimit("user", c.RateLimits.User)
+	checkLimit("toad", c.RateLimits.Toad)
+	checkLimit("stream", c.RateLimits.Stream)
+	for command, limit := range c.RateLimits.Commands {
+		checkLimit("commands."+command, limit)
+	}
+}
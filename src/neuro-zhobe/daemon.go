@@ -0,0 +1,357 @@
+package main
+
+/*
+	Daemon plugins: Root/daemons/<name>, listed in Daemons. Every toad runs
+	its own instance of each one while the toad runs, restarting it after
+	crashes with backoff.
+
+	Daemons get events on stdin, one JSON object per line:
+
+		{"event": "connect"}
+		{"event": "disconnect", "error": "..."}
+		{"event": "message", "from": {...}, "body": "hi", "private": false}
+		{"event": "presence", "nick": "user", "online": true, "new_nick": "",
+		 "jid": "", "affiliation": "member", "role": "participant"}
+		{"event": "subject", "nick": "user", "subject": "..."}
+		{"event": "ping", "id": 1}
+
+	and answer with the same actions json plugins do (see jsonplugin.go),
+	one per line, whenever they want. "reply" and "private" need "to" there,
+	and daemons may kick and change the subject: they are run by the config.
+	Pings must be answered with {"action": "pong", "id": 1} in time, or the
+	daemon is restarted. Sender "from" is the same as for json plugins.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"glb"
+	"io"
+	"log"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	daemonMinBackoff = time.Second
+	daemonMaxBackoff = time.Minute * 5
+
+	// daemon that worked for that long is considered healthy,
+	// so the backoff starts over
+	daemonBackoffReset = time.Minute
+
+	// events are dropped if the daemon is not reading them
+	daemonQueue = 256
+)
+
+type (
+	daemon struct {
+		name   string
+		zhobe  *NeuroZhobe
+		events chan []byte
+	}
+
+	daemonEvent struct {
+		Event       string        `json:"event"`
+		ID          int64         `json:"id,omitempty"`
+		Error       string        `json:"error,omitempty"`
+		From        *pluginSender `json:"from,omitempty"`
+		Body        string        `json:"body,omitempty"`
+		Private     bool          `json:"private,omitempty"`
+		Nick        string        `json:"nick,omitempty"`
+		Online      bool          `json:"online,omitempty"`
+		NewNick     string        `json:"new_nick,omitempty"`
+		JID         string        `json:"jid,omitempty"`
+		Affiliation string        `json:"affiliation,omitempty"`
+		Role        string        `json:"role,omitempty"`
+		Subject     string        `json:"subject,omitempty"`
+	}
+
+	daemonAction struct {
+		pluginAction
+		ID int64 `json:"id"`
+	}
+)
+
+func init() {
+	msgHandlers = append(msgHandlers, messageHandler{
+		name:     "daemons",
+		priority: 250, // see everything, consume nothing
+		cb:       daemonsHandler,
+	})
+}
+
+func (z *NeuroZhobe) startDaemons() {
+	for _, name := range z.config().Daemons {
+		d := &daemon{
+			name:   name,
+			zhobe:  z,
+			events: make(chan []byte, daemonQueue),
+		}
+
+		z.daemons = append(z.daemons, d)
+		z.daemonsDone.Add(1)
+		go d.supervise()
+	}
+}
+
+// emit sends the event to all the daemons of the toad
+func (z *NeuroZhobe) emit(event daemonEvent) {
+
+	if len(z.daemons) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Could not encode %v event: %v", event.Event, err)
+		return
+	}
+
+	for _, d := range z.daemons {
+		select {
+		case d.events <- data:
+		default:
+			log.Printf("Daemon %v is not reading events, dropping %v", d.name, event.Event)
+		}
+	}
+}
+
+func daemonsHandler(z *NeuroZhobe, msg *glb.MUCMessage) (bool, error) {
+
+	sender := z.pluginContext(msg, "", &arguments{}, z.senderRole(msg)).From
+
+	z.emit(daemonEvent{
+		Event:   "message",
+		From:    &sender,
+		Body:    msg.Body,
+		Private: msg.Private,
+	})
+
+	return false, nil
+}
+
+func (d *daemon) supervise() {
+
+	var (
+		z       = d.zhobe
+		backoff = daemonMinBackoff
+	)
+
+	defer z.daemonsDone.Done()
+
+	for {
+		started := time.Now()
+		err := d.run()
+
+		if z.ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) > daemonBackoffReset {
+			backoff = daemonMinBackoff
+		}
+
+		log.Printf("Daemon %v stopped: %v, restarting in %v", d.name, err, backoff)
+
+		select {
+		case <-z.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > daemonMaxBackoff {
+			backoff = daemonMaxBackoff
+		}
+	}
+}
+
+// run runs the daemon until it exits, fails a health check or the toad is stopped
+func (d *daemon) run() error {
+
+	z := d.zhobe
+
+	file, err := filepath.Abs(path.Join(z.config().Root, "daemons", d.name))
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(file)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	env, revoke := grantStore(z.pluginBucket(d.name))
+	defer revoke()
+
+	if err := z.sandbox(d.name).apply(cmd, z.config().Root, d.name, env); err != nil {
+		return err
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	log.Printf("Daemon %v started", d.name)
+
+	// events from before the start are stale
+	for len(d.events) > 0 {
+		<-d.events
+	}
+
+	var (
+		pongs    = make(chan int64, 1)
+		pings    = make(chan []byte, 1)
+		failed   = make(chan error, 1)
+		finished = make(chan error, 1)
+		logged   = make(chan struct{})
+		stop     = make(chan struct{})
+	)
+	defer close(stop)
+
+	go func() {
+		d.log(stderr)
+		close(logged)
+	}()
+
+	go func() {
+		d.read(stdout, pongs)
+		<-logged // Wait closes the pipes
+		finished <- cmd.Wait()
+	}()
+
+	// a daemon that doesn't read stdin must not block the loop below,
+	// it just fails the health check then
+	go func() {
+		failed <- d.write(stdin, pings, stop)
+	}()
+
+	var (
+		health = time.NewTicker(z.config().DaemonHealth)
+		ping   int64
+		pinged bool
+	)
+	defer health.Stop()
+
+	for {
+		select {
+		case err := <-finished:
+			return err
+
+		case <-z.ctx.Done():
+			stdin.Close() // EOF asks it to stop
+			return z.killOnShutdown(cmd, finished)
+
+		case err := <-failed:
+			z.terminate(cmd, finished)
+			return err
+
+		case id := <-pongs:
+			if id == ping {
+				pinged = false
+			}
+
+		case <-health.C:
+			if pinged {
+				z.terminate(cmd, finished)
+				return fmt.Errorf("no answer to ping in %v", z.config().DaemonHealth)
+			}
+
+			ping++
+			pinged = true
+
+			data, _ := json.Marshal(daemonEvent{Event: "ping", ID: ping})
+			select {
+			case pings <- data:
+			default:
+				// the previous one is not written yet, no answer is coming
+			}
+		}
+	}
+}
+
+// write feeds events and pings to the daemon until stopped or stdin fails
+func (d *daemon) write(stdin io.Writer, pings chan []byte, stop chan struct{}) error {
+	for {
+		var data []byte
+
+		select {
+		case <-stop:
+			return nil
+		case data = <-d.events:
+		case data = <-pings:
+		}
+
+		if _, err := stdin.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+}
+
+// read performs actions the daemon writes to stdout
+func (d *daemon) read(stdout io.Reader, pongs chan int64) {
+
+	z := d.zhobe
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var action daemonAction
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+			log.Printf("Daemon %v: bad action: %v", d.name, err)
+			continue
+		}
+
+		if action.Action == "pong" {
+			select {
+			case pongs <- action.ID:
+			default:
+			}
+			continue
+		}
+
+		if err := action.validate(); err != nil {
+			log.Printf("Daemon %v: bad action: %v", d.name, err)
+			continue
+		}
+
+		// it's only possible to do something while connected
+		if !z.isConnected() || !z.begin() {
+			log.Printf("Daemon %v: not connected, dropping %v", d.name, action.Action)
+			continue
+		}
+
+		msg := &glb.MUCMessage{From: action.To}
+		if (action.Action == "reply" || action.Action == "private") && action.To == "" {
+			log.Printf("Daemon %v: %v without recipient", d.name, action.Action)
+		} else if err := z.perform(msg, d.name, action.pluginAction); err != nil {
+			log.Printf("Daemon %v: %v failed: %v", d.name, action.Action, err)
+		}
+
+		z.end()
+	}
+}
+
+// log writes daemon stderr to the log
+func (d *daemon) log(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		log.Printf("Daemon %v: %v", d.name, scanner.Text())
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"glb"
+	"strings"
+)
+
+func init() {
+	registerCommand(&command{
+		name:        "help",
+		aliases:     []string{"h"},
+		description: "list commands or show help for one of them",
+		params:      []param{{name: "command", optional: true}},
+		handler:     helpCmd,
+	})
+}
+
+func helpCmd(z *NeuroZhobe, msg *glb.MUCMessage, args *arguments) error {
+
+	name := strings.TrimPrefix(args.String("command"), z.prefix())
+	if name == "" {
+		z.reply(msg, fmt.Sprintf("%v: %v", msg.From, z.helpList()))
+		return nil
+	}
+
+	if cmd, builtin := commands[name]; builtin {
+		z.reply(msg, fmt.Sprintf("%v: %v", msg.From, cmd.help(z.prefix())))
+		return nil
+	}
+
+	if plugin, found := z.findPlugin(name); found {
+		z.reply(msg, fmt.Sprintf("%v: %v", msg.From, z.pluginCommand(plugin).help(z.prefix())))
+		return nil
+	}
+
+	if suggestion := z.suggestCommand(name); suggestion != "" {
+		return PublicError(fmt.Errorf("No such command. Did you mean %v%v?", z.prefix(), suggestion))
+	}
+
+	return PublicError(fmt.Errorf("No such command"))
+}
+
+func (z *NeuroZhobe) helpList() string {
+
+	var builtins []string
+	for _, cmd := range builtinCommands() {
+		builtins = append(builtins, z.prefix()+cmd.name)
+	}
+
+	result := fmt.Sprintf("commands: %v", strings.Join(builtins, ", "))
+
+	if plugins := z.plugins(); len(plugins) > 0 {
+		for i := range plugins {
+			plugins[i] = z.prefix() + plugins[i]
+		}
+		result += fmt.Sprintf("; plugins: %v", strings.Join(plugins, ", "))
+	}
+
+	return result + fmt.Sprintf(". Try %vhelp <command>", z.prefix())
+}
+
+// !name usage -- description (aliases, permission)
+func (cmd *command) help(prefix string) string {
+
+	result := prefix + cmd.name
+	if usage := cmd.usageString(); usage != "" {
+		result += " " + usage
+	}
+
+	if cmd.description != "" {
+		result += " -- " + cmd.description
+	}
+
+	var notes []string
+	if len(cmd.aliases) > 0 {
+		notes = append(notes, fmt.Sprintf("aliases: %v%v", prefix, strings.Join(cmd.aliases, ", "+prefix)))
+	}
+
+	if cmd.role > roleEveryone {
+		notes = append(notes, fmt.Sprintf("%v only", cmd.role))
+	}
+
+	if len(notes) > 0 {
+		result += fmt.Sprintf(" (%v)", strings.Join(notes, "; "))
+	}
+
+	return result
+}
+
+// closest command or plugin name, empty if nothing is close enough
+func (z *NeuroZhobe) suggestCommand(name string) string {
+
+	var (
+		candidates []string
+		best       string
+		bestDist   = len(name)/3 + 1
+	)
+
+	for _, cmd := range append(builtinCommands(), z.pluginCommands()...) {
+		candidates = append(candidates, cmd.name)
+		candidates = append(candidates, cmd.aliases...)
+	}
+
+	for _, candidate := range candidates {
+		if dist := levenshtein(name, candidate); dist < bestDist {
+			best, bestDist = candidate, dist
+		}
+	}
+
+	return best
+}
+
+func levenshtein(a, b string) int {
+
+	var (
+		ra   = []rune(a)
+		rb   = []rune(b)
+		prev = make([]int, len(rb)+1)
+		cur  = make([]int, len(rb)+1)
+	)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
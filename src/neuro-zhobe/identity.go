@@ -0,0 +1,62 @@
+package main
+
+/*
+	User identity. Nicks are easy to take once their owner leaves, so users
+	are identified by their real JID when the room is not anonymous, then by
+	XEP-0421 occupant id, and only if nothing else is known, by nick:
+
+		jid:user@example.org
+		occupant:<id>
+		nick:SomeNick
+
+	Identity follows nick changes.
+*/
+
+import (
+	"glb"
+	"strings"
+)
+
+const (
+	identityJID      = "jid"
+	identityOccupant = "occupant"
+	identityNick     = "nick"
+)
+
+func presenceIdentity(p *glb.MUCPresence) string {
+	switch {
+	case p.JID != "":
+		return identityJID + ":" + p.JID
+	case p.OccupantID != "":
+		return identityOccupant + ":" + p.OccupantID
+	}
+	return ""
+}
+
+// splitIdentity("jid:user@example.org") -> "jid", "user@example.org"
+func splitIdentity(identity string) (kind, value string) {
+	tokens := strings.SplitN(identity, ":", 2)
+	if len(tokens) < 2 {
+		return identityNick, identity
+	}
+	return tokens[0], tokens[1]
+}
+
+// identity of the occupant, nicks which are not in the room are just nicks
+func (z *NeuroZhobe) identity(nick string) string {
+
+	if identity, found := z.room.identity(nick); found {
+		return identity
+	}
+
+	return identityNick + ":" + nick
+}
+
+// senderIdentity is the identity of whoever sent the message, the JID
+// is only there when the transport knows it (ad-hoc commands)
+func (z *NeuroZhobe) senderIdentity(msg *glb.MUCMessage) string {
+	if msg.JID != "" {
+		return identityJID + ":" + msg.JID
+	}
+	return z.identity(msg.From)
+}
@@ -0,0 +1,106 @@
+package main
+
+/*
+	Running plugins, so their users can change their minds: !cancel stops
+	the plugins started by the caller, operators can stop anyone's.
+*/
+
+import (
+	"fmt"
+	"glb"
+	"sync"
+	"time"
+)
+
+type (
+	job struct {
+		plugin    string
+		owner     string // identity of the one who started it
+		started   time.Time
+		cancelled chan struct{}
+		once      sync.Once
+	}
+
+	jobStore struct {
+		sync.Mutex
+		running map[*job]bool
+	}
+)
+
+func init() {
+	registerCommand(&command{
+		name:        "cancel",
+		description: "stop your running plugins, or only this one",
+		params:      []param{{name: "plugin", optional: true}},
+		handler:     cancelCmd,
+	})
+}
+
+func (s *jobStore) start(plugin, owner string) *job {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.running == nil {
+		s.running = map[*job]bool{}
+	}
+
+	j := &job{
+		plugin:    plugin,
+		owner:     owner,
+		started:   time.Now(),
+		cancelled: make(chan struct{}),
+	}
+	s.running[j] = true
+	return j
+}
+
+func (s *jobStore) finish(j *job) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.running, j)
+}
+
+// cancel stops the matching jobs, empty strings match everything
+func (s *jobStore) cancel(plugin, owner string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	count := 0
+	for j := range s.running {
+		if (plugin == "" || j.plugin == plugin) && (owner == "" || j.owner == owner) {
+			j.cancel()
+			count++
+		}
+	}
+	return count
+}
+
+func (j *job) cancel() {
+	j.once.Do(func() {
+		close(j.cancelled)
+	})
+}
+
+func cancelCmd(z *NeuroZhobe, msg *glb.MUCMessage, args *arguments) error {
+
+	plugin := args.String("plugin")
+	if plugin != "" {
+		name, found := z.findPlugin(plugin)
+		if !found {
+			return PublicError(fmt.Errorf("no such plugin"))
+		}
+		plugin = name
+	}
+
+	// operators may stop a plugin for everyone, but not everything at once
+	owner := z.senderIdentity(msg)
+	if plugin != "" && z.senderRole(msg) >= roleOperator {
+		owner = ""
+	}
+
+	if z.jobs.cancel(plugin, owner) == 0 {
+		return PublicError(fmt.Errorf("nothing to cancel"))
+	}
+
+	return nil
+}
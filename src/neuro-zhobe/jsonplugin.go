@@ -0,0 +1,301 @@
+package main
+
+/*
+	JSON plugin protocol, for plugins listed as json in PluginProtocols
+	or in their manifests.
+
+	Such plugins get no arguments, but this on stdin:
+
+		{
+			"toad": "ttyh", "room": "ttyh@conference.example.org", "bot": "Zhobe",
+			"from": {"nick": "user", "jid": "user@example.org", "identity": "jid:user@example.org",
+			         "role": "trusted", "affiliation": "member"},
+			"command": "test", "body": "!test --x=1 a b", "private": false,
+			"args": {"raw": "--x=1 a b", "tokens": ["--x=1", "a", "b"],
+			         "positional": ["a", "b"], "flags": {"x": "1"}}
+		}
+
+	and answer with actions, one JSON object per line:
+
+		{"action": "reply", "text": "to the sender"}
+		{"action": "send", "text": "to the room"}
+		{"action": "private", "to": "nick", "text": "to somebody, sender by default"}
+		{"action": "kick", "nick": "nick", "reason": "why"}
+		{"action": "subject", "text": "new subject"}
+		{"action": "store", "key": "k", "value": "v", "ttl": "1h"}  (no value deletes the key)
+
+	Output of commands that didn't come from the room (ad-hoc ones) goes
+	back to whoever ran them, "send" and "private" included. Only operators
+	can make plugins kick and change the subject.
+
+	Nothing is done if any of the lines is not a valid action. Exit status
+	is the same as for other plugins (see process.go): with a non-zero one
+	stdout is not parsed, with 64 it is a plain text error for the sender.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"glb"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	protocolPlain  = "plain"
+	protocolJSON   = "json"
+	protocolStream = "stream" // plain, but line by line, see stream.go
+)
+
+type (
+	pluginContext struct {
+		Toad    string       `json:"toad"`
+		Room    string       `json:"room"`
+		Bot     string       `json:"bot"`
+		From    pluginSender `json:"from"`
+		Command string       `json:"command"`
+		Body    string       `json:"body"`
+		Private bool         `json:"private"`
+		Args    pluginArgs   `json:"args"`
+	}
+
+	pluginSender struct {
+		Nick        string `json:"nick"`
+		JID         string `json:"jid,omitempty"`
+		Identity    string `json:"identity"`
+		Role        string `json:"role"`
+		Affiliation string `json:"affiliation,omitempty"`
+	}
+
+	pluginArgs struct {
+		Raw        string            `json:"raw"`
+		Tokens     []string          `json:"tokens"`
+		Positional []string          `json:"positional"`
+		Flags      map[string]string `json:"flags"`
+	}
+
+	pluginAction struct {
+		Action string  `json:"action"`
+		Text   string  `json:"text"`
+		To     string  `json:"to"`
+		Nick   string  `json:"nick"`
+		Reason string  `json:"reason"`
+		Key    string  `json:"key"`
+		Value  *string `json:"value"`
+		TTL    string  `json:"ttl"`
+
+		ttl time.Duration
+	}
+)
+
+func (z *NeuroZhobe) pluginProtocol(name string) string {
+	if protocol, found := z.config().PluginProtocols[name]; found {
+		return protocol
+	}
+	if protocol := z.manifestOrEmpty(name).Protocol; protocol != "" {
+		return protocol
+	}
+	return protocolPlain
+}
+
+// room name as the transport knows it
+func (z *NeuroZhobe) roomName() string {
+	switch z.config().Transport {
+	case "console":
+		return "console"
+	case "irc":
+		return z.config().IRC.Channel
+	default:
+		return z.config().Jabber.Conference
+	}
+}
+
+func (z *NeuroZhobe) pluginContext(msg *glb.MUCMessage, command string, args *arguments, r role) pluginContext {
+
+	sender := pluginSender{
+		Nick:     msg.From,
+		Identity: z.senderIdentity(msg),
+		Role:     r.String(),
+	}
+
+	if p := z.room.presence(msg.From); p != nil {
+		sender.JID = p.JID
+		sender.Affiliation = p.Affiliation.String()
+	} else if msg.JID != "" {
+		sender.JID = msg.JID
+	}
+
+	tokens, positional, flags := args.tokens, args.positional, args.flags
+
+	// nulls are not nice to deal with
+	if tokens == nil {
+		tokens = []string{}
+	}
+	if positional == nil {
+		positional = []string{}
+	}
+	if flags == nil {
+		flags = map[string]string{}
+	}
+
+	return pluginContext{
+		Toad:    z.name,
+		Room:    z.roomName(),
+		Bot:     z.bot.Nickname(),
+		From:    sender,
+		Command: command,
+		Body:    msg.Body,
+		Private: msg.Private,
+		Args: pluginArgs{
+			Raw:        args.raw,
+			Tokens:     tokens,
+			Positional: positional,
+			Flags:      flags,
+		},
+	}
+}
+
+// actions that only operators can ask for
+var operatorActions = map[string]bool{
+	"kick":    true,
+	"subject": true,
+}
+
+// parseActions checks all the actions, so that none is done if any is wrong
+func parseActions(output string) ([]pluginAction, error) {
+
+	var result []pluginAction
+
+	for i, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var action pluginAction
+		if err := json.Unmarshal([]byte(line), &action); err != nil {
+			return nil, fmt.Errorf("bad action on line %v: %v", i+1, err)
+		}
+
+		if err := action.validate(); err != nil {
+			return nil, fmt.Errorf("bad action on line %v: %v", i+1, err)
+		}
+
+		result = append(result, action)
+	}
+
+	return result, nil
+}
+
+func (a *pluginAction) validate() error {
+
+	switch a.Action {
+	case "reply", "send", "private", "subject":
+
+	case "kick":
+		if a.Nick == "" {
+			return fmt.Errorf("kick without nick")
+		}
+
+	case "store":
+		if a.Key == "" {
+			return fmt.Errorf("store without key")
+		}
+
+		if a.TTL != "" {
+			ttl, err := time.ParseDuration(a.TTL)
+			if err != nil {
+				return fmt.Errorf("bad ttl: %v", err)
+			}
+			if ttl < 0 {
+				return fmt.Errorf("negative ttl %v", a.TTL)
+			}
+			a.ttl = ttl
+		}
+
+	default:
+		return fmt.Errorf("unknown action %q", a.Action)
+	}
+
+	return nil
+}
+
+func (z *NeuroZhobe) executeJSONPlugin(plugin string, msg *glb.MUCMessage, command string, args *arguments, j *job) error {
+
+	r := z.senderRole(msg)
+
+	env, revoke := z.pluginEnv(plugin, z.senderIdentity(msg), r)
+	defer revoke()
+
+	input, err := json.Marshal(z.pluginContext(msg, command, args, r))
+	if err != nil {
+		return err
+	}
+
+	output, err := z.execute(plugin, runOptions{stdin: bytes.NewReader(input), env: env, job: j})
+	if err != nil {
+		return err
+	}
+
+	actions, err := parseActions(output)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path.Base(plugin), err)
+	}
+
+	for _, action := range actions {
+		if operatorActions[action.Action] && r < roleOperator {
+			return PublicError(fmt.Errorf("%v can't %v for you: operators only", path.Base(plugin), action.Action))
+		}
+	}
+
+	for _, action := range actions {
+		if err := z.perform(msg, path.Base(plugin), action); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// perform does what the plugin asked for, actions are validated already
+func (z *NeuroZhobe) perform(msg *glb.MUCMessage, plugin string, a pluginAction) error {
+
+	switch a.Action {
+	case "reply":
+		z.reply(msg, fmt.Sprintf("%v: %v", msg.From, a.Text))
+
+	case "send":
+		z.reply(msg, a.Text)
+
+	case "private":
+		if redirect, found := redirected(msg); found {
+			redirect(z.filterReply(msg, a.Text))
+			break
+		}
+
+		to := a.To
+		if to == "" {
+			to = msg.From
+		}
+		z.bot.SendPrivate(z.filterReply(msg, a.Text), to)
+
+	case "kick":
+		if !z.canKick(a.Nick) {
+			return PublicError(fmt.Errorf("Can't kick %v", a.Nick))
+		}
+		z.bot.Kick(a.Nick, a.Reason)
+
+	case "subject":
+		z.bot.SetSubject(a.Text)
+
+	case "store":
+		store := z.pluginBucket(plugin)
+		if a.Value == nil {
+			return store.Delete(a.Key)
+		}
+		return store.Set(a.Key, *a.Value, a.ttl)
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+/*
+	Plugin manifests: Root/plugins/<name>.yaml next to the plugin, all
+	the fields are optional, settings from the toad config take precedence.
+	Unknown keys and sandbox profiles make the manifest broken.
+
+		description: "what it does"
+		usage:       "<city> [days]"
+		aliases:     ["w"]
+		role:        trusted
+		timeout:     10s
+		sandbox:     tight           # sandbox profile
+		protocol:    json            # plain (default), json or stream
+		triggers:                    # run on matching messages, no prefix needed
+		    - "(?i)weather in (\\w+)"
+
+	Triggered plugins get submatches of the trigger (or the whole message
+	if there are none) as arguments.
+*/
+
+import (
+	"fmt"
+	"glb"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const manifestSuffix = ".yaml"
+
+type pluginManifest struct {
+	Description string
+	Usage       string
+	Aliases     []string
+	Role        string
+	Timeout     time.Duration
+	Sandbox     string
+	Protocol    string
+	Triggers    []string
+
+	triggers []*regexp.Regexp
+}
+
+func init() {
+	msgHandlers = append(msgHandlers, messageHandler{
+		name:     "triggers",
+		priority: 105, // after commands, before call
+		cb:       triggersHandler,
+	})
+}
+
+func isManifest(file string) bool {
+	return strings.HasSuffix(file, manifestSuffix)
+}
+
+// manifest of the plugin, empty one if there is none
+func (z *NeuroZhobe) manifest(name string) (*pluginManifest, error) {
+
+	var result pluginManifest
+
+	data, err := ioutil.ReadFile(path.Join(z.pluginsDir(), name+manifestSuffix))
+	if os.IsNotExist(err) {
+		return &result, nil
+	}
+	if err != nil {
+		return &result, err
+	}
+
+	// typos are errors, as they are in the config
+	var (
+		raw  map[interface{}]interface{}
+		errs configErrors
+	)
+
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return &pluginManifest{}, fmt.Errorf("%v manifest: %v", name, err)
+	}
+
+	checkKeys("", raw, reflect.TypeOf(result), &errs)
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return &pluginManifest{}, fmt.Errorf("%v manifest: %v", name, strings.Join(errs, "; "))
+	}
+
+	if err := yaml.Unmarshal(data, &result); err != nil {
+		return &pluginManifest{}, fmt.Errorf("%v manifest: %v", name, err)
+	}
+
+	if err := result.validate(); err != nil {
+		return &pluginManifest{}, fmt.Errorf("%v manifest: %v", name, err)
+	}
+
+	if _, found := z.config().SandboxProfiles[result.Sandbox]; !found && result.Sandbox != "" && result.Sandbox != defaultSandbox {
+		return &pluginManifest{}, fmt.Errorf("%v manifest: unknown sandbox profile %v", name, result.Sandbox)
+	}
+
+	return &result, nil
+}
+
+// indexed manifest of the plugin, empty one if it is not there
+func (z *NeuroZhobe) manifestOrEmpty(name string) *pluginManifest {
+	if _, manifest, found := z.index.lookup(name); found {
+		return manifest
+	}
+	return &pluginManifest{}
+}
+
+func (m *pluginManifest) validate() error {
+
+	if m.Role != "" {
+		if _, err := parseRole(m.Role); err != nil {
+			return err
+		}
+	}
+
+	switch m.Protocol {
+	case "", protocolPlain, protocolJSON, protocolStream:
+	default:
+		return fmt.Errorf("protocol must be %v, %v or %v", protocolPlain, protocolJSON, protocolStream)
+	}
+
+	if m.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+
+	for _, trigger := range m.Triggers {
+		re, err := regexp.Compile(trigger)
+		if err != nil {
+			return err
+		}
+		m.triggers = append(m.triggers, re)
+	}
+
+	return nil
+}
+
+// findPlugin finds the plugin by name or alias
+func (z *NeuroZhobe) findPlugin(command string) (string, bool) {
+
+	name, _, found := z.index.lookup(path.Base(command))
+	return name, found
+}
+
+// pluginCommand describes the plugin like a builtin command
+func (z *NeuroZhobe) pluginCommand(name string) *command {
+
+	var (
+		manifest = z.manifestOrEmpty(name)
+		r, err   = z.pluginRole(name)
+	)
+
+	if err != nil {
+		log.Printf("Bad plugin role: %v", err)
+	}
+
+	return &command{
+		name:        name,
+		aliases:     manifest.Aliases,
+		description: manifest.Description,
+		usage:       manifest.Usage,
+		role:        r,
+	}
+}
+
+// pluginCommands describes all the plugins, sorted by name
+func (z *NeuroZhobe) pluginCommands() []*command {
+	var result []*command
+	for _, name := range z.plugins() {
+		result = append(result, z.pluginCommand(name))
+	}
+	return result
+}
+
+// trigger finds the plugin which wants the message and its arguments
+func (z *NeuroZhobe) trigger(body string) (plugin string, args []string, found bool) {
+
+	for _, name := range z.plugins() {
+		for _, re := range z.manifestOrEmpty(name).triggers {
+			match := re.FindStringSubmatch(body)
+			if match == nil {
+				continue
+			}
+
+			if len(match) > 1 {
+				return name, match[1:], true
+			}
+			return name, []string{body}, true
+		}
+	}
+
+	return "", nil, false
+}
+
+func triggersHandler(z *NeuroZhobe, msg *glb.MUCMessage) (bool, error) {
+
+	name, tokens, found := z.trigger(msg.Body)
+	if !found {
+		return false, nil
+	}
+
+	// only the ones allowed to run it trigger it
+	if required, err := z.pluginRole(name); err != nil || z.senderRole(msg) < required {
+		return false, err
+	}
+
+	args := &arguments{
+		raw:        msg.Body,
+		tokens:     tokens,
+		positional: tokens,
+		flags:      map[string]string{},
+	}
+
+	return true, z.runPlugin(msg, name, args)
+}
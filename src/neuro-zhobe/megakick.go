@@ -6,26 +6,33 @@ import (
 )
 
 func init() {
-	commands["megakick"] = megakickCmd
+	registerCommand(&command{
+		name:        "megakick",
+		description: "kick somebody out of the room",
+		params:      []param{{name: "nick"}},
+		role:        roleOperator,
+		handler:     megakickCmd,
+	})
 }
 
-func megakickCmd(z *NeuroZhobe, msg *glb.MUCMessage, who string) error {
+func megakickCmd(z *NeuroZhobe, msg *glb.MUCMessage, args *arguments) error {
+
+	who := args.String("nick")
 
 	// you can't kick a cockroach
 	if who <= "" {
 		return PublicError(fmt.Errorf("WAT"))
 	}
 
-	// there we make various checks, but in general we have no way to find out if kick fails for now
-	if z.admins[who] || !z.onlines[who] || !z.admins[z.bot.Nickname()] {
+	if !z.canKick(who) {
 		return PublicError(fmt.Errorf("Can't megakick %v", who))
 	}
 
-	// only admin is able to kick
-	if !z.admins[msg.From] {
-		return PublicError(fmt.Errorf("GTFO"))
-	}
-
 	z.bot.Kick(who, "megakick")
 	return nil
 }
+
+// there we make various checks, but in general we have no way to find out if kick fails for now
+func (z *NeuroZhobe) canKick(who string) bool {
+	return !z.room.isAdmin(who) && z.role(who) < roleOperator && z.room.isOnline(who) && z.room.isAdmin(z.bot.Nickname())
+}
@@ -0,0 +1,236 @@
+package main
+
+/*
+	Message pipeline:
+
+		filters      decide if the message is handled at all (history, self, ignore list)
+		middlewares  wrap every message handler (errors, panics, timing)
+		replyFilters post-process everything sent with z.reply (length limit)
+
+	All of them (and message handlers too) can be disabled per toad by name.
+*/
+
+import (
+	"fmt"
+	"glb"
+	"log"
+	"runtime/debug"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+type (
+	handlerFunc func(*NeuroZhobe, *glb.MUCMessage) (bool, error)
+
+	messageFilter struct {
+		name     string
+		priority uint
+		cb       func(*NeuroZhobe, *glb.MUCMessage) bool // false drops the message
+	}
+
+	middleware struct {
+		name     string
+		priority uint // the more priority is, the more outer it is
+		cb       func(z *NeuroZhobe, msg *glb.MUCMessage, handler string, next handlerFunc) (bool, error)
+	}
+
+	replyFilter struct {
+		name     string
+		priority uint
+		cb       func(z *NeuroZhobe, msg *glb.MUCMessage, text string) string
+	}
+)
+
+var (
+	filters      []messageFilter
+	middlewares  []middleware
+	replyFilters []replyFilter
+
+	// handlers slower than this are reported
+	slowHandler = time.Second * 5
+)
+
+func init() {
+	filters = append(filters,
+		messageFilter{name: "history", priority: 300, cb: historyFilter},
+		messageFilter{name: "log", priority: 200, cb: logFilter},
+		messageFilter{name: "self", priority: 100, cb: selfFilter},
+		messageFilter{name: "ignore", priority: 90, cb: ignoreFilter},
+	)
+
+	middlewares = append(middlewares,
+		middleware{name: "errors", priority: 1100, cb: errorsMiddleware},
+		middleware{name: "recover", priority: 1000, cb: recoverMiddleware},
+		middleware{name: "timing", priority: 900, cb: timingMiddleware},
+	)
+
+	replyFilters = append(replyFilters,
+		replyFilter{name: "limit", priority: 100, cb: limitReply},
+	)
+}
+
+func prepareHandlers() {
+	// sort slices by priority
+	sort.Slice(msgHandlers, func(i, j int) bool {
+		return msgHandlers[i].priority > msgHandlers[j].priority
+	})
+
+	sort.Slice(filters, func(i, j int) bool {
+		return filters[i].priority > filters[j].priority
+	})
+
+	sort.Slice(middlewares, func(i, j int) bool {
+		return middlewares[i].priority > middlewares[j].priority
+	})
+
+	sort.Slice(replyFilters, func(i, j int) bool {
+		return replyFilters[i].priority > replyFilters[j].priority
+	})
+}
+
+func (z *NeuroZhobe) enabled(name string) bool {
+	for _, disabled := range z.config().Disable {
+		if disabled == name {
+			return false
+		}
+	}
+	return true
+}
+
+func (z *NeuroZhobe) dispatch(msg *glb.MUCMessage) {
+
+	for _, filter := range filters {
+		if z.enabled(filter.name) && !filter.cb(z, msg) {
+			return
+		}
+	}
+
+	for _, handler := range msgHandlers {
+		if !z.enabled(handler.name) {
+			continue
+		}
+
+		match, err := z.wrap(handler)(z, msg)
+		if err != nil {
+			// errors middleware is disabled, so just stop there
+			log.Printf("%v failed: %v", handler.name, err)
+			return
+		}
+
+		if match {
+			return
+		}
+	}
+}
+
+// wrap handler into all the enabled middlewares
+func (z *NeuroZhobe) wrap(handler messageHandler) handlerFunc {
+
+	result := handler.cb
+
+	// inner ones are applied first
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if !z.enabled(middlewares[i].name) {
+			continue
+		}
+
+		var (
+			mw   = middlewares[i]
+			next = result
+		)
+
+		result = func(z *NeuroZhobe, msg *glb.MUCMessage) (bool, error) {
+			return mw.cb(z, msg, handler.name, next)
+		}
+	}
+
+	return result
+}
+
+func (z *NeuroZhobe) filterReply(msg *glb.MUCMessage, text string) string {
+	for _, filter := range replyFilters {
+		if z.enabled(filter.name) {
+			text = filter.cb(z, msg, text)
+		}
+	}
+	return text
+}
+
+func historyFilter(z *NeuroZhobe, msg *glb.MUCMessage) bool {
+	return !msg.History // skip old messags
+}
+
+func logFilter(z *NeuroZhobe, msg *glb.MUCMessage) bool {
+	log.Printf("%v: %v", msg.From, msg.Body)
+	return true
+}
+
+func selfFilter(z *NeuroZhobe, msg *glb.MUCMessage) bool {
+	return msg.From != z.bot.Nickname() // skip self messages
+}
+
+func ignoreFilter(z *NeuroZhobe, msg *glb.MUCMessage) bool {
+	for _, nick := range z.config().Ignore {
+		if nick == msg.From {
+			return false
+		}
+	}
+	return true
+}
+
+func errorsMiddleware(z *NeuroZhobe, msg *glb.MUCMessage, handler string, next handlerFunc) (bool, error) {
+
+	match, err := next(z, msg)
+	if err == nil {
+		return match, nil
+	}
+
+	if _, public := err.(publicError); public {
+		// public errors can be directly sent to chat
+		z.reply(msg, fmt.Sprintf("%v: %v", msg.From, err.Error()))
+		return match, nil
+	}
+
+	// any other error is considered private
+	// and sent only to OPs in PM
+	log.Printf("%v failed: %v", handler, err)
+	z.reply(msg, fmt.Sprintf("%v: 542 SHIT HAPPEND", msg.From))
+	z.notifyOperators(err.Error())
+
+	return true, nil
+}
+
+func recoverMiddleware(z *NeuroZhobe, msg *glb.MUCMessage, handler string, next handlerFunc) (match bool, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%v panicked: %v\n%s", handler, r, debug.Stack())
+			match, err = true, fmt.Errorf("%v panicked: %v", handler, r)
+		}
+	}()
+
+	return next(z, msg)
+}
+
+func timingMiddleware(z *NeuroZhobe, msg *glb.MUCMessage, handler string, next handlerFunc) (bool, error) {
+
+	started := time.Now()
+	match, err := next(z, msg)
+
+	if took := time.Since(started); took > slowHandler {
+		log.Printf("%v took %v to handle %q", handler, took, msg.Body)
+	}
+
+	return match, err
+}
+
+func limitReply(z *NeuroZhobe, msg *glb.MUCMessage, text string) string {
+
+	limit := z.config().MaxReplyLength
+	if limit <= 0 || utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+
+	return string([]rune(text)[:limit]) + "…"
+}
@@ -0,0 +1,220 @@
+package main
+
+/*
+	Roles: everyone < trusted < operator < owner.
+
+	Roles are assigned in config by JID, nickname or MUC affiliation, and at
+	runtime with !role. Runtime assignments are made to user identities
+	(see identity.go), kept in the "roles" bucket of the store and only
+	add to the configured ones. When no affiliations are configured,
+	moderators with owner or admin affiliation are operators.
+*/
+
+import (
+	"fmt"
+	"glb"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	role uint
+
+	RolesConfig struct {
+		JIDs         map[string]string `yaml:"jids"`
+		Nicks        map[string]string
+		Affiliations map[string]string // owner, admin, member, none or moderator -> role
+	}
+)
+
+const (
+	roleEveryone = role(iota)
+	roleTrusted
+	roleOperator
+	roleOwner
+)
+
+var roleNames = []string{"everyone", "trusted", "operator", "owner"}
+
+func init() {
+	registerCommand(&command{
+		name:        "role",
+		description: "show somebody's role or assign it (operators only)",
+		params:      []param{{name: "who"}, {name: "role", optional: true}},
+		handler:     roleCmd,
+	})
+}
+
+func (r role) String() string {
+	if int(r) < len(roleNames) {
+		return roleNames[r]
+	}
+	return fmt.Sprintf("role(%d)", r)
+}
+
+func parseRole(name string) (role, error) {
+	for i, known := range roleNames {
+		if known == name {
+			return role(i), nil
+		}
+	}
+	return roleEveryone, fmt.Errorf("unknown role %v, known are: %v", name, strings.Join(roleNames, ", "))
+}
+
+// role required to run the plugin
+func (z *NeuroZhobe) pluginRole(name string) (role, error) {
+	configured, found := z.config().PluginRoles[name]
+	if !found {
+		configured = z.manifestOrEmpty(name).Role
+	}
+	if configured == "" {
+		return roleEveryone, nil
+	}
+	return parseRole(configured)
+}
+
+// role of a room occupant
+func (z *NeuroZhobe) role(nick string) role {
+	return z.roleOf(nick, z.identity(nick))
+}
+
+// senderRole is the role of whoever sent the message
+func (z *NeuroZhobe) senderRole(msg *glb.MUCMessage) role {
+	return z.roleOf(msg.From, z.senderIdentity(msg))
+}
+
+func (z *NeuroZhobe) roleOf(nick, identity string) role {
+
+	result := z.configuredRole(nick, identity)
+
+	if assigned, err := parseRole(z.assignedRole(identity)); err == nil && assigned > result {
+		result = assigned
+	}
+
+	return result
+}
+
+// configuredRole is the role from the config, runtime assignments can't lower it
+func (z *NeuroZhobe) configuredRole(nick, identity string) role {
+
+	var (
+		result   = roleEveryone
+		cfg      = z.config().Roles
+		presence = z.room.presence(nick)
+	)
+
+	raise := func(name string) {
+		if name == "" {
+			return
+		}
+		if r, err := parseRole(name); err == nil && r > result {
+			result = r
+		}
+	}
+
+	if presence != nil {
+		if len(cfg.Affiliations) == 0 {
+			if presence.Admin {
+				raise(roleOperator.String())
+			}
+		} else {
+			raise(cfg.Affiliations[presence.Affiliation.String()])
+			if presence.Role == glb.RoleModerator {
+				raise(cfg.Affiliations["moderator"])
+			}
+		}
+	}
+
+	if kind, jid := splitIdentity(identity); kind == identityJID {
+		raise(cfg.JIDs[jid])
+	}
+
+	raise(cfg.Nicks[nick])
+
+	return result
+}
+
+// notifyOperators sends the text privately to the operators in the room
+func (z *NeuroZhobe) notifyOperators(text string) {
+	for _, nick := range z.room.nicks() {
+		if nick != z.bot.Nickname() && z.role(nick) >= roleOperator {
+			z.bot.SendPrivate(text, nick)
+		}
+	}
+}
+
+// role assigned with !role, empty if none
+func (z *NeuroZhobe) assignedRole(identity string) string {
+	assigned, _ := z.bucket("roles").Get(identity)
+	return assigned
+}
+
+// assign role at runtime, everyone removes the assignment
+func (z *NeuroZhobe) assignRole(identity string, r role) error {
+	if r == roleEveryone {
+		return z.bucket("roles").Delete(identity)
+	}
+	return z.bucket("roles").Set(identity, r.String(), 0)
+}
+
+// importRoles brings the assignments from the times roles.yaml was used
+func (z *NeuroZhobe) importRoles() {
+	z.importLegacy("roles.yaml", func(data []byte) error {
+		var roles map[string]string
+		if err := yaml.Unmarshal(data, &roles); err != nil {
+			return err
+		}
+
+		for identity, assigned := range roles {
+			if err := z.bucket("roles").Set(identity, assigned, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func roleCmd(z *NeuroZhobe, msg *glb.MUCMessage, args *arguments) error {
+
+	who := args.String("who")
+
+	if args.String("role") == "" {
+		z.reply(msg, fmt.Sprintf("%v: %v is %v", msg.From, who, z.role(who)))
+		return nil
+	}
+
+	var (
+		own         = z.senderRole(msg)
+		wanted, err = parseRole(args.String("role"))
+	)
+
+	if err != nil {
+		return PublicError(err)
+	}
+
+	// nobody can grant or take away more than they have
+	if own < roleOperator || wanted > own || z.role(who) > own {
+		return PublicError(fmt.Errorf("GTFO"))
+	}
+
+	// whoever takes the nick next would get the role
+	identity := z.identity(who)
+	if kind, _ := splitIdentity(identity); kind == identityNick {
+		return PublicError(fmt.Errorf("%v has no JID or occupant id, roles can't be given to bare nicks", who))
+	}
+
+	if err := z.assignRole(identity, wanted); err != nil {
+		return err
+	}
+
+	// configured roles always apply, runtime ones only add to them
+	if effective := z.role(who); effective != wanted {
+		z.reply(msg, fmt.Sprintf("%v: %v (%v) is %v now: that's the configured role, %v only applies when it's higher",
+			msg.From, who, identity, effective, wanted))
+		return nil
+	}
+
+	z.reply(msg, fmt.Sprintf("%v: %v (%v) is %v now", msg.From, who, identity, wanted))
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"glb"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// testBot remembers what is sent to the room
+type testBot struct {
+	sent []string
+}
+
+func (b *testBot) Disconnect()                           {}
+func (b *testBot) Wait()                                 {}
+func (b *testBot) Free()                                 {}
+func (b *testBot) Nickname() string                      { return "bot" }
+func (b *testBot) Send(message string)                   { b.sent = append(b.sent, message) }
+func (b *testBot) SendPrivate(message, recipient string) {}
+func (b *testBot) Kick(who, forWhat string)              {}
+func (b *testBot) SetSubject(subject string)             {}
+func (b *testBot) Leave(goodbye string)                  {}
+
+func TestRoleCmd(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "zhobe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	z := newZhobe(context.Background(), "test", &Config{
+		Root:  root,
+		Roles: RolesConfig{Nicks: map[string]string{"boss": "operator"}},
+	})
+	z.bot = &testBot{}
+	z.store, err = openStore(path.Join(root, "store.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z.room.update(&glb.MUCPresence{Nick: "boss", Online: true})
+	z.room.update(&glb.MUCPresence{Nick: "known", OccupantID: "abc", Online: true})
+	z.room.update(&glb.MUCPresence{Nick: "anonymous", Online: true})
+
+	var (
+		msg  = &glb.MUCMessage{From: "boss"}
+		role = func(args ...string) error {
+			a, err := parseArguments(strings.Join(args, " "))
+			if err == nil {
+				err = a.bind(commands["role"].params)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			return roleCmd(z, msg, a)
+		}
+	)
+
+	// the role would go to whoever takes the nick next
+	for _, who := range []string{"anonymous", "nobody"} {
+		if err := role(who, "trusted"); err == nil {
+			t.Errorf("%v got a role", who)
+		} else if _, public := err.(publicError); !public {
+			t.Errorf("%v: %v is not public", who, err)
+		}
+		if z.role(who) != roleEveryone {
+			t.Errorf("%v is %v", who, z.role(who))
+		}
+	}
+
+	if err := role("known", "trusted"); err != nil {
+		t.Fatal(err)
+	}
+	if z.role("known") != roleTrusted {
+		t.Errorf("known is %v", z.role("known"))
+	}
+}
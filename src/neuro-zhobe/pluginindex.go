@@ -0,0 +1,338 @@
+package main
+
+/*
+	Plugin index: Root/plugins is scanned when the toad starts and watched
+	with inotify, so plugins (and their manifests) can be added, removed
+	or chmod-ed on the fly. Broken plugins (not executable, bad manifest,
+	clashing names) are left out of the index and reported to the
+	operators in the room, once more on every connect. Ad-hoc commands
+	follow the index.
+*/
+
+import (
+	"fmt"
+	"glb"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type pluginIndex struct {
+	sync.RWMutex
+
+	plugins map[string]*pluginManifest // name -> manifest, working ones only
+	aliases map[string]string          // alias -> name
+	broken  map[string]string          // name -> what is wrong with it
+}
+
+const (
+	// changes usually come in bursts (editor saves, git checkouts)
+	pluginRescanDelay = time.Millisecond * 200
+
+	// occupants come right after connecting, operators among them
+	brokenReportDelay = time.Second * 10
+
+	pluginWatchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+		syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB
+)
+
+func init() {
+	registerCommand(&command{
+		name:        "plugins",
+		description: "list available plugins",
+		handler:     pluginsCmd,
+	})
+}
+
+func (z *NeuroZhobe) pluginsDir() string {
+	return path.Join(z.config().Root, "./plugins/")
+}
+
+// scanPlugins rebuilds the index, newly broken plugins are reported
+func (z *NeuroZhobe) scanPlugins() {
+
+	var (
+		plugins = map[string]*pluginManifest{}
+		aliases = map[string]string{}
+		broken  = map[string]string{}
+	)
+
+	files, err := ioutil.ReadDir(z.pluginsDir())
+	if err != nil {
+		log.Printf("Could not list plugins: %v", err)
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if isManifest(name) || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		// symlinks are fine as long as they point to executables
+		info, err := os.Stat(path.Join(z.pluginsDir(), name))
+		switch {
+		case err != nil:
+			broken[name] = err.Error()
+			continue
+		case info.IsDir():
+			continue
+		case !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0:
+			broken[name] = "not executable"
+			continue
+		}
+
+		// builtins are looked up first, such a plugin would never run
+		if _, builtin := commands[name]; builtin {
+			broken[name] = "the name is taken by a command"
+			continue
+		}
+
+		manifest, err := z.manifest(name)
+		if err != nil {
+			broken[name] = err.Error()
+			continue
+		}
+
+		plugins[name] = manifest
+	}
+
+	// aliases must not hide anything
+	var names []string
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, alias := range plugins[name].Aliases {
+			_, builtin := commands[alias]
+			_, plugin := plugins[alias]
+			other, taken := aliases[alias]
+
+			if builtin || plugin {
+				broken[name] = fmt.Sprintf("alias %v is taken by a command", alias)
+				break
+			}
+			if taken {
+				broken[name] = fmt.Sprintf("alias %v is taken by %v", alias, other)
+				break
+			}
+			aliases[alias] = name
+		}
+
+		if _, isBroken := broken[name]; isBroken {
+			delete(plugins, name)
+			for alias, owner := range aliases {
+				if owner == name {
+					delete(aliases, alias)
+				}
+			}
+		}
+	}
+
+	index := &z.index
+	index.Lock()
+	previous := index.broken
+	index.plugins, index.aliases, index.broken = plugins, aliases, broken
+	index.Unlock()
+
+	for _, name := range sortedNames(broken) {
+		if broken[name] != previous[name] {
+			z.reportBroken(name, broken[name])
+		}
+	}
+
+	z.announcePlugins()
+}
+
+// watchPlugins scans the plugins, then rescans them in background
+// every time something changes there, until the toad is stopped
+func (z *NeuroZhobe) watchPlugins() {
+
+	// watch first, so nothing is missed between the scan and the watch
+	defer z.scanPlugins()
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		log.Printf("Could not watch plugins: %v", err)
+		return
+	}
+
+	// non-blocking descriptors go to the poller, so Close interrupts Read
+	events := os.NewFile(uintptr(fd), "inotify")
+
+	if _, err := syscall.InotifyAddWatch(fd, z.pluginsDir(), pluginWatchMask); err != nil {
+		log.Printf("Could not watch plugins: %v", err)
+		events.Close()
+		return
+	}
+
+	changed := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			if _, err := events.Read(buf); err != nil {
+				if z.ctx.Err() == nil {
+					log.Printf("Stopped watching plugins: %v", err)
+				}
+				close(changed)
+				return
+			}
+
+			select {
+			case changed <- true:
+			default:
+			}
+		}
+	}()
+
+	go func() {
+		<-z.ctx.Done()
+		events.Close()
+	}()
+
+	go func() {
+		for range changed {
+			time.Sleep(pluginRescanDelay)
+
+			// drop what came while sleeping, it is going to be seen by this scan
+			select {
+			case <-changed:
+			default:
+			}
+
+			z.scanPlugins()
+		}
+	}()
+}
+
+// reports made while disconnected are only logged, reportAllBroken
+// repeats them after connecting
+func (z *NeuroZhobe) reportBroken(name, reason string) {
+
+	log.Printf("Broken plugin %v: %v", name, reason)
+
+	if !z.isConnected() || !z.begin() {
+		return
+	}
+	defer z.end()
+
+	z.notifyOperators(fmt.Sprintf("Plugin %v is broken: %v", name, reason))
+}
+
+// reportAllBroken tells the operators about all the broken plugins once
+// they are seen in the room
+func (z *NeuroZhobe) reportAllBroken() {
+
+	if len(z.index.brokenOnes()) == 0 {
+		return
+	}
+
+	select {
+	case <-z.ctx.Done():
+		return
+	case <-time.After(brokenReportDelay):
+	}
+
+	if !z.isConnected() || !z.begin() {
+		return
+	}
+	defer z.end()
+
+	broken := z.index.brokenOnes()
+	for _, name := range sortedNames(broken) {
+		z.notifyOperators(fmt.Sprintf("Plugin %v is broken: %v", name, broken[name]))
+	}
+}
+
+// lookup finds a working plugin by name or alias
+func (i *pluginIndex) lookup(command string) (string, *pluginManifest, bool) {
+	i.RLock()
+	defer i.RUnlock()
+
+	if manifest, found := i.plugins[command]; found {
+		return command, manifest, true
+	}
+
+	if name, found := i.aliases[command]; found {
+		return name, i.plugins[name], true
+	}
+
+	return "", nil, false
+}
+
+// names of the working plugins, sorted
+func (i *pluginIndex) names() []string {
+	i.RLock()
+	defer i.RUnlock()
+
+	var result []string
+	for name := range i.plugins {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+func (i *pluginIndex) brokenOnes() map[string]string {
+	i.RLock()
+	defer i.RUnlock()
+
+	result := map[string]string{}
+	for name, reason := range i.broken {
+		result[name] = reason
+	}
+	return result
+}
+
+// broken plugin names, sorted
+func sortedNames(broken map[string]string) []string {
+	var result []string
+	for name := range broken {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+func pluginsCmd(z *NeuroZhobe, msg *glb.MUCMessage, args *arguments) error {
+
+	var available []string
+	for _, cmd := range z.pluginCommands() {
+		entry := z.prefix() + cmd.name
+		if len(cmd.aliases) > 0 {
+			entry += fmt.Sprintf(" (%v%v)", z.prefix(), strings.Join(cmd.aliases, ", "+z.prefix()))
+		}
+		available = append(available, entry)
+	}
+
+	result := "no plugins"
+	if len(available) > 0 {
+		result = fmt.Sprintf("plugins: %v", strings.Join(available, ", "))
+	}
+
+	// what is wrong is only interesting to the ones who can fix it
+	if z.senderRole(msg) >= roleOperator {
+		broken := z.index.brokenOnes()
+
+		var entries []string
+		for _, name := range sortedNames(broken) {
+			entries = append(entries, fmt.Sprintf("%v (%v)", name, broken[name]))
+		}
+
+		if len(entries) > 0 {
+			result += fmt.Sprintf("; broken: %v", strings.Join(entries, ", "))
+		}
+	}
+
+	z.reply(msg, fmt.Sprintf("%v: %v", msg.From, result))
+	return nil
+}
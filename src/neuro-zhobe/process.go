@@ -0,0 +1,327 @@
+package main
+
+/*
+	Plugin processes. Every plugin runs in its own process group, so
+	anything it spawns is stopped together with it: SIGTERM first, then
+	SIGKILL if the group is still there after killDelay (isolated plugins
+	get SIGKILL right away, see sandbox.go). That happens when
+	the plugin runs out of time, or when the toad is stopped and the plugin
+	is still running after PluginGrace.
+
+	Exit status of a plugin decides what happens to its output:
+
+		0                    stdout is the answer
+		64 (pluginUserError) stdout explains what the user did wrong,
+		                     it is sent to the chat as a public error
+		anything else        internal error, stderr goes to the operators
+
+	Stderr is always logged line by line, but it is just a log: it doesn't
+	make a plugin fail.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// how long a plugin has to exit after SIGTERM
+	killDelay = time.Second * 2
+
+	// EX_USAGE from sysexits.h
+	pluginUserError = 64
+
+	// incomplete line is passed as it is after that, prompts and
+	// progress bars don't end with a newline
+	lineQuietPeriod = time.Second * 2
+)
+
+type (
+	timeoutError struct {
+		name    string
+		timeout time.Duration
+	}
+
+	// plugin failed on its own
+	pluginError struct {
+		name   string
+		state  *os.ProcessState
+		stderr string
+	}
+
+	// how to run the plugin, everything is optional
+	runOptions struct {
+		stdin io.Reader
+		env   []string
+		job   *job // started by somebody, so it can be cancelled
+
+		// streaming: gets stdout line by line instead of the result,
+		// false stops the plugin
+		lines func(line string) bool
+	}
+
+	// lineWriter passes complete lines on until it is told to stop
+	lineWriter struct {
+		sync.Mutex
+
+		cb      func(line string) bool
+		buf     []byte
+		quiet   *time.Timer   // passes the incomplete line if nothing else comes
+		stopped chan struct{} // closed when cb returns false
+	}
+)
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("%v took too long (more than %v), killed", e.name, e.timeout)
+}
+
+func (e pluginError) Error() string {
+	if e.stderr == "" {
+		return fmt.Sprintf("%v: %v", e.name, e.state)
+	}
+	return fmt.Sprintf("%v: %v: %v", e.name, e.state, e.stderr)
+}
+
+// how long the plugin may run
+func (z *NeuroZhobe) pluginTimeout(name string) time.Duration {
+	if timeout, found := z.config().PluginTimeouts[name]; found {
+		return timeout
+	}
+	if timeout := z.manifestOrEmpty(name).Timeout; timeout > 0 {
+		return timeout
+	}
+	return z.config().PluginTimeout
+}
+
+func (z *NeuroZhobe) execute(file string, opts runOptions, args ...string) (string, error) {
+	// exec and get output
+	// arguments are passed as is, there is no shell in between
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command(file, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	var (
+		name    = path.Base(file)
+		timeout = z.pluginTimeout(name)
+		started = time.Now()
+
+		stdout, stderr bytes.Buffer
+
+		// never happen unless the options say so
+		cancelled <-chan struct{}
+		stopped   <-chan struct{}
+	)
+
+	if err := z.sandbox(name).apply(cmd, z.config().Root, name, opts.env); err != nil {
+		return "", err
+	}
+
+	cmd.Stdin = opts.stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if opts.job != nil {
+		cancelled = opts.job.cancelled
+	}
+
+	if opts.lines != nil {
+		lines := newLineWriter(opts.lines)
+		defer lines.flush()
+
+		cmd.Stdout = lines
+		stopped = lines.stopped
+	}
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	finished := make(chan error, 1)
+	go func() {
+		finished <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-finished:
+
+	case <-time.After(timeout):
+		z.terminate(cmd, finished)
+		err = PublicError(timeoutError{name: name, timeout: timeout})
+
+	case <-cancelled:
+		z.terminate(cmd, finished)
+		err = PublicError(fmt.Errorf("%v cancelled", name))
+
+	case <-stopped:
+		// the one who streams it has seen enough, or it is cancelled
+		z.terminate(cmd, finished)
+		select {
+		case <-cancelled:
+			err = PublicError(fmt.Errorf("%v cancelled", name))
+		default:
+			err = nil
+		}
+
+	case <-z.ctx.Done():
+		err = z.killOnShutdown(cmd, finished)
+	}
+
+	log.Printf("%v: %v, took %v", name, cmd.ProcessState, time.Since(started).Round(time.Millisecond))
+	logStderr(name, stderr.String())
+
+	var (
+		output  = strings.TrimRight(stdout.String(), " \t\n")
+		_, exit = err.(*exec.ExitError)
+	)
+
+	switch {
+	case err == nil:
+		return output, nil
+
+	case exit && cmd.ProcessState.ExitCode() == pluginUserError:
+		if output == "" {
+			output = fmt.Sprintf("%v failed", name)
+		}
+		return "", PublicError(errors.New(output))
+
+	case exit:
+		return "", pluginError{
+			name:   name,
+			state:  cmd.ProcessState,
+			stderr: strings.TrimSpace(stderr.String()),
+		}
+	}
+
+	// timeouts, shutdown
+	return "", err
+}
+
+func newLineWriter(cb func(line string) bool) *lineWriter {
+	w := &lineWriter{cb: cb, stopped: make(chan struct{})}
+
+	w.quiet = time.AfterFunc(lineQuietPeriod, w.flush)
+	w.quiet.Stop()
+
+	return w
+}
+
+// Write never fails, output is just dropped when it is not needed anymore
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.quiet.Stop()
+	w.buf = append(w.buf, p...)
+
+	for {
+		end := bytes.IndexByte(w.buf, '\n')
+		if end < 0 {
+			break
+		}
+
+		line := string(w.buf[:end])
+		w.buf = w.buf[end+1:]
+		w.pass(line)
+	}
+
+	if len(w.buf) > 0 {
+		w.quiet.Reset(lineQuietPeriod)
+	}
+
+	return len(p), nil
+}
+
+// flush passes the incomplete line left, if any
+func (w *lineWriter) flush() {
+	w.Lock()
+	defer w.Unlock()
+
+	w.quiet.Stop()
+	if len(w.buf) > 0 {
+		w.pass(string(w.buf))
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) pass(line string) {
+
+	select {
+	case <-w.stopped:
+		return
+	default:
+	}
+
+	if line = strings.TrimRight(line, " \t\r"); line == "" {
+		return
+	}
+
+	if !w.cb(line) {
+		close(w.stopped)
+	}
+}
+
+func logStderr(name, stderr string) {
+	for _, line := range strings.Split(strings.TrimRight(stderr, "\n"), "\n") {
+		if line != "" {
+			log.Printf("%v: %v", name, line)
+		}
+	}
+}
+
+// terminate stops the process group of the plugin and waits for the plugin
+func (z *NeuroZhobe) terminate(cmd *exec.Cmd, finished chan error) error {
+
+	group := -cmd.Process.Pid
+
+	// pid 1 would just ignore SIGTERM
+	if !isolated(cmd) {
+		if err := syscall.Kill(group, syscall.SIGTERM); err != nil {
+			log.Printf("Could not terminate %v: %v", cmd.Path, err)
+		}
+
+		select {
+		case err := <-finished:
+			// plugin is gone, but its children may be not
+			syscall.Kill(group, syscall.SIGKILL)
+			return err
+		case <-time.After(killDelay):
+		}
+	}
+
+	if err := syscall.Kill(group, syscall.SIGKILL); err != nil {
+		log.Printf("Could not kill %v: %v", cmd.Path, err)
+	}
+
+	return <-finished
+}
+
+// killOnShutdown gives the plugin PluginGrace to finish, then stops it
+func (z *NeuroZhobe) killOnShutdown(cmd *exec.Cmd, finished chan error) error {
+
+	select {
+	case err := <-finished:
+		return err
+	case <-time.After(z.config().PluginGrace):
+	}
+
+	log.Printf("Stopping %v: still running after %v", cmd.Path, z.config().PluginGrace)
+	atomic.AddInt32(&z.killed, 1)
+
+	return z.terminate(cmd, finished)
+}
@@ -0,0 +1,98 @@
+package main
+
+/*
+	Publishes bot vCard and avatar on connect,
+	but only if they were changed since the last time
+	the server accepted them
+*/
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"glb"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+func (z *NeuroZhobe) publishProfile() {
+
+	bot, ok := z.bot.(*glb.GBot)
+	if !ok {
+		return // only xmpp has profiles
+	}
+
+	var (
+		jabber = z.config().Jabber
+		photo  []byte
+		err    error
+	)
+
+	if jabber.Avatar == "" && jabber.VCard == (glb.VCard{}) {
+		return // nothing to publish
+	}
+
+	if jabber.Avatar != "" {
+		photo, err = ioutil.ReadFile(jabber.Avatar)
+		if err != nil {
+			log.Printf("Could not read avatar: %v", err)
+			return
+		}
+	}
+
+	var (
+		hash    = fmt.Sprintf("%x", sha1.Sum(append([]byte(fmt.Sprintf("%+v", jabber.VCard)), photo...)))
+		hashKey = strings.Split(jabber.JID, "/")[0]
+		store   = z.bucket("profile")
+	)
+
+	if published, _ := store.Get(hashKey); published == hash {
+		return // already there
+	}
+
+	var photoType string
+	if len(photo) > 0 {
+		photoType = http.DetectContentType(photo)
+	}
+
+	// it is stored once the server says it is fine
+	z.profile.Lock()
+	z.profile.key, z.profile.hash = hashKey, hash
+	z.profile.Unlock()
+
+	var width, height int
+	if img, _, err := image.DecodeConfig(bytes.NewReader(photo)); err == nil {
+		width, height = img.Width, img.Height
+	}
+
+	bot.PublishProfile(jabber.VCard, photoType, photo, width, height)
+}
+
+func (z *NeuroZhobe) OnProfilePublished(ok bool) {
+
+	z.profile.Lock()
+	key, hash := z.profile.key, z.profile.hash
+	z.profile.key, z.profile.hash = "", ""
+	z.profile.Unlock()
+
+	if !ok {
+		log.Println("Server rejected vCard or avatar, trying again on the next connect")
+		return
+	}
+
+	if key == "" {
+		return
+	}
+
+	log.Println("Published vCard and avatar")
+
+	if err := z.bucket("profile").Set(key, hash, 0); err != nil {
+		log.Printf("Could not store profile hash: %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+/*
+	Rate limits for commands and chat, per user, per command and per toad.
+	Users hitting limits too often are ignored for a while, and kicked if
+	the bot is able to. Operators are exempt.
+*/
+
+import (
+	"fmt"
+	"glb"
+	"log"
+	"sync"
+	"time"
+)
+
+type (
+	RateLimit struct {
+		Count int
+		Per   time.Duration
+	}
+
+	RateLimitsConfig struct {
+		User      RateLimit            // all the commands of one user
+		Toad      RateLimit            // all the commands in the room
+		Commands  map[string]RateLimit // one command of one user
+		Stream    RateLimit            // lines of streaming plugins, 5 per 5s by default
+		Strikes   int                  // limit hits before user is ignored, 3 by default
+		IgnoreFor time.Duration        `yaml:"ignore_for"` // 10m by default
+		Kick      bool                 // kick ignored users
+	}
+
+	// events within the last period
+	slidingWindow struct {
+		events []time.Time
+		per    time.Duration
+	}
+
+	limiter struct {
+		sync.Mutex
+
+		windows map[string]*slidingWindow // including "strikes <identity>", limit hits
+		ignored map[string]time.Time      // identity -> until
+		pruned  time.Time
+	}
+)
+
+// idle windows and old ignores are forgotten that often
+const limiterPruneInterval = time.Minute
+
+func init() {
+	middlewares = append(middlewares, middleware{
+		name:     "ratelimit",
+		priority: 800,
+		cb:       rateLimitMiddleware,
+	})
+}
+
+// fits forgets old events and checks if one more is allowed
+func (w *slidingWindow) fits(now time.Time, count int, per time.Duration) bool {
+
+	recent := w.events[:0]
+	for _, at := range w.events {
+		if now.Sub(at) < per {
+			recent = append(recent, at)
+		}
+	}
+	w.events = recent
+
+	return len(w.events) < count
+}
+
+func (w *slidingWindow) add(now time.Time) {
+	w.events = append(w.events, now)
+}
+
+// time until the next event fits
+func (w *slidingWindow) wait(now time.Time, per time.Duration) time.Duration {
+	if len(w.events) == 0 {
+		return 0
+	}
+	return per - now.Sub(w.events[0])
+}
+
+func (l *limiter) window(key string, per time.Duration) *slidingWindow {
+	if l.windows == nil {
+		l.windows = map[string]*slidingWindow{}
+	}
+
+	w, found := l.windows[key]
+	if !found {
+		w = &slidingWindow{}
+		l.windows[key] = w
+	}
+
+	// the period may be changed by a reload
+	w.per = per
+	return w
+}
+
+// prune forgets the windows without recent events and expired ignores
+func (l *limiter) prune(now time.Time) {
+
+	if now.Sub(l.pruned) < limiterPruneInterval {
+		return
+	}
+	l.pruned = now
+
+	for key, w := range l.windows {
+		if len(w.events) == 0 || now.Sub(w.events[len(w.events)-1]) >= w.per {
+			delete(l.windows, key)
+		}
+	}
+
+	for identity, until := range l.ignored {
+		if now.After(until) {
+			delete(l.ignored, identity)
+		}
+	}
+}
+
+// check returns how long to wait, zero if the command is allowed
+func (l *limiter) check(cfg *RateLimitsConfig, identity, command string) time.Duration {
+
+	var (
+		now    = time.Now()
+		limits = map[string]RateLimit{
+			"toad":                                cfg.Toad,
+			"user " + identity:                    cfg.User,
+			"command " + identity + " " + command: cfg.Commands[command],
+		}
+	)
+
+	l.prune(now)
+
+	// all the limits must allow it before anything is recorded
+	for key, limit := range limits {
+		if limit.Count <= 0 {
+			continue
+		}
+		if w := l.window(key, limit.Per); !w.fits(now, limit.Count, limit.Per) {
+			return w.wait(now, limit.Per)
+		}
+	}
+
+	for key, limit := range limits {
+		if limit.Count > 0 {
+			l.window(key, limit.Per).add(now)
+		}
+	}
+
+	return 0
+}
+
+// take returns how long to wait, zero if one more event fits and is recorded
+func (l *limiter) take(key string, limit RateLimit) time.Duration {
+
+	if limit.Count <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.prune(now)
+
+	w := l.window(key, limit.Per)
+
+	if !w.fits(now, limit.Count, limit.Per) {
+		return w.wait(now, limit.Per)
+	}
+
+	w.add(now)
+	return 0
+}
+
+// strike returns true if user must be ignored now, strikes older than
+// IgnoreFor don't count
+func (l *limiter) strike(cfg *RateLimitsConfig, identity string) bool {
+
+	var (
+		now = time.Now()
+		key = "strikes " + identity
+		w   = l.window(key, cfg.IgnoreFor)
+	)
+
+	if w.fits(now, cfg.Strikes-1, cfg.IgnoreFor) {
+		w.add(now)
+		return false
+	}
+
+	if l.ignored == nil {
+		l.ignored = map[string]time.Time{}
+	}
+
+	delete(l.windows, key)
+	l.ignored[identity] = now.Add(cfg.IgnoreFor)
+	return true
+}
+
+func (l *limiter) isIgnored(identity string) bool {
+	until, found := l.ignored[identity]
+	if found && time.Now().After(until) {
+		delete(l.ignored, identity)
+		return false
+	}
+	return found
+}
+
+// name of the rate limited thing the message is about, empty if none
+func (z *NeuroZhobe) limitedCommand(handler string, msg *glb.MUCMessage) string {
+	switch handler {
+	case "commands":
+		command, _, ok := z.parseCommand(msg.Body)
+		if !ok {
+			return ""
+		}
+
+		// aliases share the limits of their commands
+		if cmd, builtin := commands[command]; builtin {
+			return cmd.name
+		}
+		if plugin, found := z.findPlugin(command); found {
+			return plugin
+		}
+
+		// all the typos count as one
+		return "unknown"
+	case "call":
+		if z.CallRegexp().MatchString(msg.Body) {
+			return "call"
+		}
+	case "triggers":
+		if plugin, _, found := z.trigger(msg.Body); found {
+			return plugin
+		}
+	}
+	return ""
+}
+
+func rateLimitMiddleware(z *NeuroZhobe, msg *glb.MUCMessage, handler string, next handlerFunc) (bool, error) {
+
+	var (
+		cfg      = z.config().RateLimits
+		command  = z.limitedCommand(handler, msg)
+		identity = z.senderIdentity(msg)
+	)
+
+	if command == "" || z.senderRole(msg) >= roleOperator {
+		return next(z, msg)
+	}
+
+	if cfg.Strikes <= 0 {
+		cfg.Strikes = 3
+	}
+
+	if cfg.IgnoreFor <= 0 {
+		cfg.IgnoreFor = time.Minute * 10
+	}
+
+	z.limits.Lock()
+
+	if z.limits.isIgnored(identity) {
+		z.limits.Unlock()
+		return true, nil // drop silently
+	}
+
+	wait := z.limits.check(&cfg, identity, command)
+	if wait == 0 {
+		z.limits.Unlock()
+		return next(z, msg)
+	}
+
+	ignore := z.limits.strike(&cfg, identity)
+	z.limits.Unlock()
+
+	if !ignore {
+		return true, PublicError(fmt.Errorf("slow down, try again in %v", wait.Round(time.Second)))
+	}
+
+	log.Printf("Ignoring %v (%v) for %v: too many commands", msg.From, identity, cfg.IgnoreFor)
+
+	if cfg.Kick && z.room.isAdmin(z.bot.Nickname()) && !z.room.isAdmin(msg.From) {
+		z.bot.Kick(msg.From, "flood")
+		return true, nil
+	}
+
+	return true, PublicError(fmt.Errorf("you are ignored for %v", cfg.IgnoreFor))
+}
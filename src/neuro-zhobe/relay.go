@@ -0,0 +1,178 @@
+package main
+
+/*
+	Relays messages between toads (and so between their rooms).
+
+	Loops are avoided since relayed messages are sent by the bot itself,
+	and bots never handle their own messages.
+*/
+
+import (
+	"fmt"
+	"glb"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	relayAll      = "all"
+	relayCommands = "commands"
+	relayMentions = "mentions"
+)
+
+type (
+	RelayConfig struct {
+		From   string // toad name
+		To     string // toad name
+		TwoWay bool   `yaml:"two_way"`
+		Filter string // all (default), commands or mentions
+		Match  string // optional regexp
+		Rate   int    // messages per minute, 20 by default
+	}
+
+	// one-way link between two toads
+	relay struct {
+		sync.Mutex
+
+		from, to string
+		filter   string
+		match    *regexp.Regexp
+		rate     int
+		sent     slidingWindow
+	}
+)
+
+var (
+	relays     []*relay
+	relaysSync sync.RWMutex
+)
+
+func init() {
+	msgHandlers = append(msgHandlers, messageHandler{
+		name:     "relay",
+		priority: 200, // before anything that could consume the message
+		cb:       relayHandler,
+	})
+
+	configLoadedHandlers = append(configLoadedHandlers, loadRelays)
+}
+
+func loadRelays(old, new *NeuroConfig) {
+
+	var (
+		result []*relay
+		seen   = map[string]bool{}
+	)
+
+	for _, cfg := range new.Relays {
+
+		var match *regexp.Regexp
+		if cfg.Match != "" {
+			var err error
+			if match, err = regexp.Compile(cfg.Match); err != nil {
+				log.Printf("Relay %v -> %v: bad regexp: %v", cfg.From, cfg.To, err)
+				continue
+			}
+		}
+
+		if cfg.Filter == "" {
+			cfg.Filter = relayAll
+		}
+
+		if cfg.Rate == 0 {
+			cfg.Rate = 20
+		}
+
+		links := [][2]string{{cfg.From, cfg.To}}
+		if cfg.TwoWay {
+			links = append(links, [2]string{cfg.To, cfg.From})
+		}
+
+		for _, link := range links {
+			key := link[0] + " " + link[1]
+			if link[0] == link[1] || seen[key] {
+				log.Printf("Relay %v -> %v: skipping duplicate or loop", link[0], link[1])
+				continue
+			}
+			seen[key] = true
+
+			result = append(result, &relay{
+				from:   link[0],
+				to:     link[1],
+				filter: cfg.Filter,
+				match:  match,
+				rate:   cfg.Rate,
+			})
+		}
+	}
+
+	relaysSync.Lock()
+	relays = result
+	relaysSync.Unlock()
+}
+
+func (r *relay) accepts(z *NeuroZhobe, msg *glb.MUCMessage) bool {
+
+	switch r.filter {
+	case relayCommands:
+		if _, _, ok := z.parseCommand(msg.Body); !ok {
+			return false
+		}
+	case relayMentions:
+		if !z.CallRegexp().MatchString(msg.Body) {
+			return false
+		}
+	}
+
+	return r.match == nil || r.match.MatchString(msg.Body)
+}
+
+// true if one more message fits into the rate limit
+func (r *relay) allow() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	if !r.sent.fits(now, r.rate, time.Minute) {
+		return false
+	}
+
+	r.sent.add(now)
+	return true
+}
+
+func relayHandler(z *NeuroZhobe, msg *glb.MUCMessage) (bool, error) {
+
+	if msg.Private {
+		return false, nil
+	}
+
+	relaysSync.RLock()
+	defer relaysSync.RUnlock()
+
+	for _, r := range relays {
+		if r.from != z.name || !r.accepts(z, msg) {
+			continue
+		}
+
+		toadsSync.RLock()
+		target, online := toads[r.to]
+		toadsSync.RUnlock()
+
+		if !online {
+			continue
+		}
+
+		if !r.allow() {
+			log.Printf("Relay %v -> %v: rate limit exceeded, dropping message", r.from, r.to)
+			continue
+		}
+
+		target.bot.Send(fmt.Sprintf("<%v> %v", msg.From, msg.Body))
+	}
+
+	// relaying never consumes the message
+	return false, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+/*
+	Config reload on SIGHUP or !reload. New toads are started, removed ones
+	are stopped, toads with changed connection settings (or daemons) are
+	restarted and the rest of the settings are applied in place.
+*/
+
+import (
+	"fmt"
+	"glb"
+	"log"
+	"sync"
+)
+
+var reloadSync sync.Mutex
+
+func init() {
+	registerCommand(&command{
+		name:        "reload",
+		description: "re-read config",
+		role:        roleOperator,
+		handler:     reloadCmd,
+	})
+}
+
+func reloadConfig() error {
+
+	loaded, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	applyConfig(loaded)
+	return nil
+}
+
+func applyConfig(loaded *NeuroConfig) {
+
+	reloadSync.Lock()
+	defer reloadSync.Unlock()
+
+	old := config
+	config = loaded
+
+	for name := range old.Zhobe {
+		if _, found := loaded.Zhobe[name]; !found {
+			stopToad(name)
+		}
+	}
+
+	for name, cfg := range loaded.Zhobe {
+
+		runnersSync.Lock()
+		r, running := runners[name]
+		runnersSync.Unlock()
+
+		if !running {
+			startToad(name, cfg)
+			continue
+		}
+
+		applyDefaults(&cfg)
+
+		if restartNeeded(r.zhobe.config(), &cfg) {
+			stopToad(name)
+			startToad(name, cfg)
+			continue
+		}
+
+		// everything else is read from config on demand
+		r.zhobe.setConfig(&cfg)
+
+		// manifests name sandbox profiles, which may be gone now
+		r.zhobe.scanPlugins()
+	}
+
+	for _, cb := range configLoadedHandlers {
+		go cb(old, loaded)
+	}
+
+	log.Println("Config reloaded")
+}
+
+func reloadCmd(z *NeuroZhobe, msg *glb.MUCMessage, args *arguments) error {
+
+	// details are for the log, they may mention paths and variables
+	loaded, err := readConfig()
+	if err != nil {
+		log.Printf("Could not reload config:\n%v", err)
+		return PublicError(fmt.Errorf("could not reload config, see the log"))
+	}
+
+	z.reply(msg, fmt.Sprintf("%v: reloading", msg.From))
+
+	// this toad could be restarted by the reload,
+	// and it waits for running handlers (this one too)
+	go applyConfig(loaded)
+
+	return nil
+}
@@ -0,0 +1,347 @@
+package main
+
+/*
+	Room state: who is in the room now, and what is known about everyone
+	who has ever been there. Occupants are stored by identity (see
+	identity.go), so they are recognized after nick changes and rejoins.
+	Everything but the presences is kept in the "seen" bucket of the store.
+*/
+
+import (
+	"fmt"
+	"glb"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	occupant struct {
+		Nick      string    // current or last nick
+		LastNick  string    `yaml:"last_nick"` // nick before that
+		Identity  string    `yaml:"-"`         // it is the key
+		FirstSeen time.Time `yaml:"first_seen"`
+		LastSeen  time.Time `yaml:"last_seen"` // last presence from them
+		LastSpoke time.Time `yaml:"last_spoke"`
+
+		online   bool
+		presence *glb.MUCPresence
+	}
+
+	roomStore struct {
+		sync.RWMutex
+
+		dirty  bool                 // changed since saved
+		online map[string]*occupant // nick -> occupant, only the ones in the room
+		known  map[string]*occupant // identity -> occupant
+	}
+)
+
+// room state is saved that often, and on shutdown
+const roomSaveInterval = time.Minute
+
+func init() {
+	filters = append(filters, messageFilter{
+		name:     "seen",
+		priority: 250, // after history, so old messages don't count
+		cb:       seenFilter,
+	})
+
+	registerCommand(&command{
+		name:        "seen",
+		description: "when somebody was here and talked last time",
+		params:      []param{{name: "nick"}},
+		handler:     seenCmd,
+	})
+}
+
+func newRoomStore() roomStore {
+	return roomStore{
+		online: map[string]*occupant{},
+		known:  map[string]*occupant{},
+	}
+}
+
+func (s *roomStore) update(p *glb.MUCPresence) {
+	s.Lock()
+	defer s.Unlock()
+
+	var (
+		now      = time.Now()
+		occ      = s.online[p.Nick]
+		identity = presenceIdentity(p)
+	)
+
+	s.dirty = true
+
+	// identity follows nick changes
+	if p.NewNick != "" {
+		if occ != nil {
+			delete(s.online, p.Nick)
+			occ.LastNick, occ.Nick = p.Nick, p.NewNick
+			occ.LastSeen = now
+			s.online[p.NewNick] = occ
+		}
+		return
+	}
+
+	if !p.Online {
+		if occ != nil {
+			delete(s.online, p.Nick)
+			occ.online = false
+			occ.presence = p
+			occ.LastSeen = now
+		}
+		return
+	}
+
+	switch {
+	case identity != "":
+	case occ != nil:
+		identity = occ.Identity
+	default:
+		identity = identityNick + ":" + p.Nick
+	}
+
+	known, found := s.known[identity]
+	if !found {
+		known = &occupant{Identity: identity, FirstSeen: now}
+		s.known[identity] = known
+	}
+
+	if known.Nick != "" && known.Nick != p.Nick {
+		known.LastNick = known.Nick
+	}
+
+	known.Nick = p.Nick
+	known.LastSeen = now
+	known.online = true
+	known.presence = p
+
+	s.online[p.Nick] = known
+}
+
+// leftAll marks everyone offline, presences come again after reconnecting
+func (s *roomStore) leftAll() {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for nick, occ := range s.online {
+		occ.online = false
+		occ.presence = nil
+		occ.LastSeen = now
+		delete(s.online, nick)
+	}
+
+	s.dirty = true
+}
+
+func (s *roomStore) spoke(nick string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if occ, found := s.online[nick]; found {
+		occ.LastSpoke = time.Now()
+		s.dirty = true
+	}
+}
+
+// last presence of the occupant, nil if they are not in the room
+func (s *roomStore) presence(nick string) *glb.MUCPresence {
+	s.RLock()
+	defer s.RUnlock()
+
+	if occ, found := s.online[nick]; found {
+		return occ.presence
+	}
+	return nil
+}
+
+// nicks of everyone in the room
+func (s *roomStore) nicks() []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	var result []string
+	for nick := range s.online {
+		result = append(result, nick)
+	}
+	return result
+}
+
+func (s *roomStore) isOnline(nick string) bool {
+	return s.presence(nick) != nil
+}
+
+func (s *roomStore) isAdmin(nick string) bool {
+	p := s.presence(nick)
+	return p != nil && p.Admin
+}
+
+// isPresent tells if somebody with this identity is in the room
+func (s *roomStore) isPresent(identity string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, occ := range s.online {
+		if occ.Identity == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *roomStore) identity(nick string) (string, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if occ, found := s.online[nick]; found {
+		return occ.Identity, true
+	}
+	return "", false
+}
+
+// find looks for the occupant by nick, ones in the room come first
+func (s *roomStore) find(nick string) (occupant, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if occ, found := s.online[nick]; found {
+		return *occ, true
+	}
+
+	var result *occupant
+	for _, occ := range s.known {
+		matches := strings.EqualFold(occ.Nick, nick) || strings.EqualFold(occ.LastNick, nick)
+		if matches && (result == nil || occ.LastSeen.After(result.LastSeen)) {
+			result = occ
+		}
+	}
+
+	if result == nil {
+		return occupant{}, false
+	}
+	return *result, true
+}
+
+// everyone known is stored as one value, it is saved every minute anyway
+const roomKey = "occupants"
+
+func (z *NeuroZhobe) loadRoom() {
+	s := &z.room
+	s.Lock()
+	defer s.Unlock()
+
+	load := func(data []byte) error {
+		var known map[string]*occupant
+		if err := yaml.Unmarshal(data, &known); err != nil {
+			return err
+		}
+
+		for identity, occ := range known {
+			occ.Identity = identity
+			s.known[identity] = occ
+		}
+		return nil
+	}
+
+	z.importLegacy("seen.yaml", func(data []byte) error {
+		s.dirty = true
+		return load(data)
+	})
+
+	if data, found := z.bucket("seen").Get(roomKey); found {
+		if err := load([]byte(data)); err != nil {
+			log.Printf("Could not parse room state: %v", err)
+		}
+	}
+}
+
+func (z *NeuroZhobe) saveRoom() error {
+	s := &z.room
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	data, err := yaml.Marshal(s.known)
+	if err != nil {
+		return err
+	}
+
+	if err := z.bucket("seen").Set(roomKey, string(data), 0); err != nil {
+		return err
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// keepRoom saves room state from time to time until the toad is stopped
+func (z *NeuroZhobe) keepRoom() {
+
+	ticker := time.NewTicker(roomSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-z.ctx.Done():
+			return
+		}
+
+		if err := z.saveRoom(); err != nil {
+			log.Printf("Could not save room state: %v", err)
+		}
+	}
+}
+
+func seenFilter(z *NeuroZhobe, msg *glb.MUCMessage) bool {
+	if !msg.Private {
+		z.room.spoke(msg.From)
+	}
+	return true
+}
+
+// ago formats time passed since t
+func ago(t time.Time) string {
+	return time.Since(t).Round(time.Second).String()
+}
+
+func seenCmd(z *NeuroZhobe, msg *glb.MUCMessage, args *arguments) error {
+
+	nick := args.String("nick")
+
+	occ, found := z.room.find(nick)
+	if !found {
+		z.reply(msg, fmt.Sprintf("%v: never seen %v", msg.From, nick))
+		return nil
+	}
+
+	var answer string
+	switch {
+	case occ.online && occ.Nick == nick:
+		answer = fmt.Sprintf("%v is here", nick)
+	case occ.online:
+		answer = fmt.Sprintf("%v is here as %v", nick, occ.Nick)
+	case !strings.EqualFold(occ.Nick, nick):
+		answer = fmt.Sprintf("%v left as %v %v ago", nick, occ.Nick, ago(occ.LastSeen))
+	default:
+		answer = fmt.Sprintf("%v left %v ago", nick, ago(occ.LastSeen))
+	}
+
+	if !occ.LastSpoke.IsZero() {
+		answer += fmt.Sprintf(", last spoke %v ago", ago(occ.LastSpoke))
+	}
+
+	answer += fmt.Sprintf(", first seen %v", occ.FirstSeen.Format("2006-01-02"))
+
+	z.reply(msg, fmt.Sprintf("%v: %v", msg.From, answer))
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+/*
+	Plugin sandbox. Plugins are run in sandbox profiles, "default" one
+	unless PluginSandbox says otherwise, and without any profile plugins
+	still get a scrubbed environment.
+
+	Resource limits can't be set for a child process directly, so the bot
+	runs itself as "neuro-zhobe sandbox-exec cpu=N as=N nofile=N uid=N gid=N
+	-- plugin args...", which sets them and turns into the plugin.
+
+	Every plugin works in a directory of its own, Root/work/<plugin> unless
+	the profile says otherwise, never in the directory of the bot with its
+	config and secrets.
+
+	Isolated plugins get their own network (with nothing but loopback in
+	it, so no store either), pid, ipc and hostname namespaces. Unprivileged
+	bot puts them into a new user namespace as well. An isolated plugin is
+	pid 1 of its namespace, and pid 1 ignores signals it has no handler
+	for, SIGTERM included, so isolated plugins are stopped with SIGKILL
+	right away. The whole namespace goes down with its pid 1.
+*/
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type SandboxConfig struct {
+	CPU     time.Duration // CPU time, rounded up to seconds
+	Memory  uint64        // address space, MiB
+	Files   uint64        // open files
+	Env     []string      // environment variables to keep, defaultEnv if empty
+	Dir     string        // plugins work in Dir/<plugin>, relative to Root, defaultSandboxDir if empty
+	UID     *uint32       `yaml:"uid"`
+	GID     *uint32       `yaml:"gid"`
+	Isolate bool          // new namespaces, no network
+}
+
+const (
+	sandboxCommand = "sandbox-exec"
+	defaultSandbox = "default"
+
+	defaultSandboxDir = "work"
+)
+
+var (
+	defaultEnv = []string{"PATH", "HOME", "LANG", "LC_ALL", "TZ"}
+
+	rlimits = map[string]int{
+		"cpu":    syscall.RLIMIT_CPU,
+		"as":     syscall.RLIMIT_AS,
+		"nofile": syscall.RLIMIT_NOFILE,
+	}
+)
+
+// sandbox profile of the plugin, zero one if there is none
+func (z *NeuroZhobe) sandbox(name string) SandboxConfig {
+	profile, found := z.config().PluginSandbox[name]
+	if !found {
+		profile = z.manifestOrEmpty(name).Sandbox
+	}
+	if profile == "" {
+		profile = defaultSandbox
+	}
+
+	result, found := z.config().SandboxProfiles[profile]
+	if !found && profile != defaultSandbox {
+		// better safe than sorry
+		log.Printf("Unknown sandbox profile %v for %v, using %v", profile, name, defaultSandbox)
+		result = z.config().SandboxProfiles[defaultSandbox]
+	}
+	return result
+}
+
+// apply prepares cmd to run in the sandbox, env is added to allowed variables
+func (s SandboxConfig) apply(cmd *exec.Cmd, root, name string, env []string) error {
+
+	allowed := s.Env
+	if len(allowed) == 0 {
+		allowed = defaultEnv
+	}
+
+	cmd.Env = nil
+	for _, name := range allowed {
+		if value, found := os.LookupEnv(name); found {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+	}
+	cmd.Env = append(cmd.Env, env...)
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := cmd.SysProcAttr
+
+	var (
+		uid = uint32(os.Getuid())
+		gid = uint32(os.Getgid())
+	)
+
+	if s.UID != nil {
+		uid = *s.UID
+	}
+
+	if s.GID != nil {
+		gid = *s.GID
+	}
+
+	if s.UID != nil || s.GID != nil {
+		attr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	}
+
+	dir := s.Dir
+	if dir == "" {
+		dir = defaultSandboxDir
+	}
+	if !path.IsAbs(dir) {
+		dir = path.Join(root, dir)
+	}
+	dir = path.Join(dir, name)
+
+	if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return err
+	}
+
+	if attr.Credential != nil {
+		if err := os.Chown(dir, int(uid), int(gid)); err != nil {
+			return err
+		}
+	}
+
+	cmd.Dir = dir
+
+	if s.Isolate {
+		attr.Cloneflags = syscall.CLONE_NEWNET | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+
+		if os.Getuid() != 0 {
+			attr.Cloneflags |= syscall.CLONE_NEWUSER
+			attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: int(uid), HostID: os.Getuid(), Size: 1}}
+			attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: int(gid), HostID: os.Getgid(), Size: 1}}
+			attr.Credential = nil // there is nobody else in there
+		}
+	}
+
+	var limits []string
+
+	if s.CPU > 0 {
+		limits = append(limits, fmt.Sprintf("cpu=%d", (s.CPU+time.Second-1)/time.Second))
+	}
+
+	if s.Memory > 0 {
+		limits = append(limits, fmt.Sprintf("as=%d", s.Memory<<20))
+	}
+
+	if s.Files > 0 {
+		limits = append(limits, fmt.Sprintf("nofile=%d", s.Files))
+	}
+
+	if len(limits) > 0 {
+		// the bot binary may be not executable by the plugin user,
+		// so helper switches to that user itself
+		if attr.Credential != nil {
+			limits = append(limits, fmt.Sprintf("gid=%d", gid), fmt.Sprintf("uid=%d", uid))
+			attr.Credential = nil
+		}
+
+		// the child is still the bot right after fork, so that's its binary
+		args := append([]string{os.Args[0], sandboxCommand}, limits...)
+		cmd.Args = append(append(args, "--", cmd.Path), cmd.Args[1:]...)
+		cmd.Path = "/proc/self/exe"
+	}
+
+	return nil
+}
+
+// isolated tells if the plugin is pid 1 of its own namespace
+func isolated(cmd *exec.Cmd) bool {
+	return cmd.SysProcAttr != nil && cmd.SysProcAttr.Cloneflags&syscall.CLONE_NEWPID != 0
+}
+
+// sandboxExec sets resource limits, switches user and executes the plugin
+func sandboxExec(args []string) {
+
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", sandboxCommand, err)
+		os.Exit(127)
+	}
+
+	settings := map[string]uint64{}
+	for len(args) > 0 && args[0] != "--" {
+		tokens := strings.SplitN(args[0], "=", 2)
+		if len(tokens) < 2 {
+			fail(fmt.Errorf("bad setting %v", args[0]))
+		}
+
+		value, err := strconv.ParseUint(tokens[1], 10, 64)
+		if err != nil {
+			fail(err)
+		}
+
+		settings[tokens[0]] = value
+		args = args[1:]
+	}
+
+	if len(args) < 2 {
+		fail(fmt.Errorf("nothing to execute"))
+	}
+
+	for name, value := range settings {
+		resource, found := rlimits[name]
+		if !found {
+			continue
+		}
+
+		limit := &syscall.Rlimit{Cur: value, Max: value}
+		if resource == syscall.RLIMIT_CPU {
+			limit.Max++ // SIGXCPU first, then SIGKILL
+		}
+
+		if err := syscall.Setrlimit(resource, limit); err != nil {
+			fail(err)
+		}
+	}
+
+	// limits can be lowered by anyone, but user is changed only once
+	if gid, found := settings["gid"]; found {
+		if err := syscall.Setgroups(nil); err != nil {
+			fail(err)
+		}
+		if err := syscall.Setgid(int(gid)); err != nil {
+			fail(err)
+		}
+	}
+
+	if uid, found := settings["uid"]; found {
+		if err := syscall.Setuid(int(uid)); err != nil {
+			fail(err)
+		}
+	}
+
+	fail(syscall.Exec(args[1], args[1:], os.Environ()))
+}
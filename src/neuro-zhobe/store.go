@@ -0,0 +1,256 @@
+package main
+
+/*
+	Key-value store. Every toad has its own, kept in Root/store.<toad>.yaml,
+	and everything in it belongs to some namespace:
+
+		builtin/<name>  built-in features, see z.bucket()
+		plugin/<name>   plugins, see storehttp.go
+
+	Every change is written to disk right away. Values may expire, setting
+	a value without ttl makes it permanent even if the old one expired.
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	storeItem struct {
+		Value   string
+		Expires *time.Time `yaml:",omitempty"` // never, if nil
+	}
+
+	kvStore struct {
+		sync.Mutex
+
+		file  string
+		items map[string]map[string]storeItem // namespace -> key -> item
+	}
+
+	// one namespace of the store
+	bucket struct {
+		store     *kvStore
+		namespace string
+	}
+
+	// update func gets the current value and returns the new one,
+	// returning false deletes the key
+	updateFunc func(value string, found bool) (string, bool, error)
+)
+
+// openStore fails if the file is there but can't be read, the first
+// save would overwrite it otherwise; broken one is moved aside
+func openStore(file string) (*kvStore, error) {
+
+	s := &kvStore{
+		file:  file,
+		items: map[string]map[string]storeItem{},
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, &s.items); err != nil {
+		aside := fmt.Sprintf("%v.broken-%v", file, time.Now().Format("20060102-150405"))
+		if err := os.Rename(file, aside); err != nil {
+			return nil, err
+		}
+
+		log.Printf("Could not parse store, starting with an empty one, the old one is %v: %v", aside, err)
+		s.items = map[string]map[string]storeItem{}
+	}
+
+	return s, nil
+}
+
+// bucket of a built-in feature
+func (z *NeuroZhobe) bucket(name string) bucket {
+	return bucket{store: z.store, namespace: "builtin/" + name}
+}
+
+// bucket of a plugin
+func (z *NeuroZhobe) pluginBucket(name string) bucket {
+	return bucket{store: z.store, namespace: "plugin/" + name}
+}
+
+func (i storeItem) expired(now time.Time) bool {
+	return i.Expires != nil && !now.Before(*i.Expires)
+}
+
+// save must be called with the lock held
+func (s *kvStore) save() error {
+
+	// forget expired items on the way
+	now := time.Now()
+	for namespace, items := range s.items {
+		for key, item := range items {
+			if item.expired(now) {
+				delete(items, key)
+			}
+		}
+		if len(items) == 0 {
+			delete(s.items, namespace)
+		}
+	}
+
+	data, err := yaml.Marshal(s.items)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, os.FileMode(0600)); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.file)
+}
+
+func (b bucket) Get(key string) (string, bool) {
+	b.store.Lock()
+	defer b.store.Unlock()
+
+	item, found := b.store.items[b.namespace][key]
+	if !found || item.expired(time.Now()) {
+		return "", false
+	}
+	return item.Value, true
+}
+
+// Keys returns sorted keys with the prefix
+func (b bucket) Keys(prefix string) []string {
+	b.store.Lock()
+	defer b.store.Unlock()
+
+	var (
+		now    = time.Now()
+		result []string
+	)
+
+	for key, item := range b.store.items[b.namespace] {
+		if strings.HasPrefix(key, prefix) && !item.expired(now) {
+			result = append(result, key)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// Update changes the value atomically, zero ttl means it never expires:
+// expiry of the old value is dropped, not kept
+func (b bucket) Update(key string, ttl time.Duration, update updateFunc) (string, error) {
+	b.store.Lock()
+	defer b.store.Unlock()
+
+	var (
+		now         = time.Now()
+		items       = b.store.items[b.namespace]
+		item, found = items[key]
+	)
+
+	if found && item.expired(now) {
+		item, found = storeItem{}, false
+	}
+
+	value, keep, err := update(item.Value, found)
+	if err != nil {
+		return "", err
+	}
+
+	if items == nil {
+		items = map[string]storeItem{}
+		b.store.items[b.namespace] = items
+	}
+
+	if !keep {
+		delete(items, key)
+		return "", b.store.save()
+	}
+
+	item = storeItem{Value: value}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		item.Expires = &expires
+	}
+
+	items[key] = item
+	return value, b.store.save()
+}
+
+func (b bucket) Set(key, value string, ttl time.Duration) error {
+	_, err := b.Update(key, ttl, func(string, bool) (string, bool, error) {
+		return value, true, nil
+	})
+	return err
+}
+
+func (b bucket) Delete(key string) error {
+	_, err := b.Update(key, 0, func(string, bool) (string, bool, error) {
+		return "", false, nil
+	})
+	return err
+}
+
+// Increment adds delta to the integer value, missing one is zero
+func (b bucket) Increment(key string, delta int64, ttl time.Duration) (string, error) {
+	return b.Update(key, ttl, func(value string, found bool) (string, bool, error) {
+		var current int64
+		if found {
+			var err error
+			if current, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return "", false, fmt.Errorf("%v is not a number", key)
+			}
+		}
+		return strconv.FormatInt(current+delta, 10), true, nil
+	})
+}
+
+// importLegacy feeds Root/<file>, which used to be shared by all the toads,
+// to load once; it is left in place for the other toads
+func (z *NeuroZhobe) importLegacy(file string, load func(data []byte) error) {
+
+	migrated := z.bucket("migrated")
+	if _, done := migrated.Get(file); done {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path.Join(z.config().Root, file))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not read %v: %v", file, err)
+		return
+	}
+
+	if err == nil {
+		if err := load(data); err != nil {
+			log.Printf("Could not import %v: %v", file, err)
+			return
+		}
+		log.Printf("Imported %v", file)
+	}
+
+	if err := migrated.Set(file, time.Now().Format(time.RFC3339), 0); err != nil {
+		log.Printf("Could not store %v import: %v", file, err)
+	}
+}
+
+func (z *NeuroZhobe) storeFile() string {
+	return path.Join(z.config().Root, fmt.Sprintf("store.%v.yaml", z.name))
+}
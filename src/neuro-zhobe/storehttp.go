@@ -0,0 +1,180 @@
+package main
+
+/*
+	Store for plugins, over HTTP on loopback. Plugins get ZHOBE_STORE (URL)
+	and ZHOBE_STORE_TOKEN, which gives access to the namespace of the plugin
+	while it runs. With A="Authorization: Bearer $ZHOBE_STORE_TOKEN":
+
+		curl -H "$A" $ZHOBE_STORE/key                            get
+		curl -H "$A" -X PUT -d value "$ZHOBE_STORE/key?ttl=1h"   set, for an hour (forever without ttl)
+		curl -H "$A" -X PUT -H "If-Match: old" -d new ...        set if it's still "old"
+		curl -H "$A" -X PUT -H "If-None-Match: *" -d value ...   set if it's not set
+		curl -H "$A" -X POST "$ZHOBE_STORE/key?incr=1"           increment, get the result
+		curl -H "$A" -X DELETE $ZHOBE_STORE/key                  delete
+		curl -H "$A" "$ZHOBE_STORE/?prefix=foo"                  keys, one per line
+
+	Failed conditions are 412, unknown keys are 404.
+*/
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxStoreValue = 64 * 1024
+
+var (
+	// token -> bucket of the running plugin
+	storeGrants     = map[string]bucket{}
+	storeGrantsSync sync.Mutex
+
+	storeURL string
+
+	errPrecondition = errors.New("precondition failed")
+)
+
+func startStoreServer(addr string) error {
+
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	storeURL = fmt.Sprintf("http://%v", listener.Addr())
+	log.Printf("Plugin store is at %v", storeURL)
+
+	go func() {
+		log.Printf("Plugin store stopped: %v", http.Serve(listener, http.HandlerFunc(serveStore)))
+	}()
+
+	return nil
+}
+
+// grantStore gives access to the bucket until revoked
+func grantStore(b bucket) (env []string, revoke func()) {
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		log.Printf("Could not generate store token: %v", err)
+		return nil, func() {}
+	}
+
+	token := hex.EncodeToString(random)
+
+	storeGrantsSync.Lock()
+	storeGrants[token] = b
+	storeGrantsSync.Unlock()
+
+	env = []string{"ZHOBE_STORE=" + storeURL, "ZHOBE_STORE_TOKEN=" + token}
+
+	return env, func() {
+		storeGrantsSync.Lock()
+		delete(storeGrants, token)
+		storeGrantsSync.Unlock()
+	}
+}
+
+func serveStore(w http.ResponseWriter, r *http.Request) {
+
+	storeGrantsSync.Lock()
+	b, granted := storeGrants[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	storeGrantsSync.Unlock()
+
+	if !granted {
+		http.Error(w, "bad token", http.StatusForbidden)
+		return
+	}
+
+	var (
+		key   = strings.TrimPrefix(r.URL.Path, "/")
+		query = r.URL.Query()
+		ttl   time.Duration
+		err   error
+	)
+
+	if query.Get("ttl") != "" {
+		if ttl, err = time.ParseDuration(query.Get("ttl")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if key == "" && r.Method != http.MethodGet {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+
+	var result string
+
+	switch r.Method {
+	case http.MethodGet:
+		if key == "" {
+			result = strings.Join(b.Keys(query.Get("prefix")), "\n")
+			break
+		}
+
+		value, found := b.Get(key)
+		if !found {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		result = value
+
+	case http.MethodPut:
+		body, readErr := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxStoreValue))
+		if readErr != nil {
+			http.Error(w, readErr.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		var (
+			ifMatch     = r.Header.Get("If-Match")
+			ifNoneMatch = r.Header.Get("If-None-Match")
+		)
+
+		result, err = b.Update(key, ttl, func(value string, found bool) (string, bool, error) {
+			if ifNoneMatch == "*" && found || ifMatch != "" && (!found || ifMatch != value) {
+				return "", false, errPrecondition
+			}
+			return string(body), true, nil
+		})
+
+	case http.MethodPost:
+		var delta int64
+		if delta, err = strconv.ParseInt(query.Get("incr"), 10, 64); err != nil {
+			http.Error(w, "incr must be a number", http.StatusBadRequest)
+			return
+		}
+		result, err = b.Increment(key, delta, ttl)
+
+	case http.MethodDelete:
+		err = b.Delete(key)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case err == errPrecondition:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		fmt.Fprint(w, result)
+	}
+}
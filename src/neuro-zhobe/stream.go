@@ -0,0 +1,68 @@
+package main
+
+/*
+	Streaming plugins (stream protocol) are run like plain ones, but every
+	line they print is sent as soon as it is there, not when they exit.
+	Lines are limited by RateLimits.Stream, there are at most StreamLines
+	of them per run: the plugin is stopped when it prints one more, so a
+	plugin that prints exactly StreamLines lines runs on quietly and the
+	"stopped after" notice is not sent. Incomplete lines are sent after
+	lineQuietPeriod without output (see process.go).
+*/
+
+import (
+	"fmt"
+	"glb"
+	"path"
+	"time"
+)
+
+var defaultStreamRate = RateLimit{Count: 5, Per: time.Second * 5}
+
+func (z *NeuroZhobe) executeStreamingPlugin(plugin string, msg *glb.MUCMessage, args *arguments, j *job) error {
+
+	var (
+		name  = path.Base(plugin)
+		limit = z.config().RateLimits.Stream
+		sent  = 0
+	)
+
+	if limit.Count <= 0 {
+		limit = defaultStreamRate
+	}
+
+	lines := func(line string) bool {
+
+		// this is the line over the cap, nothing is known before it comes
+		if sent >= z.config().StreamLines {
+			z.reply(msg, fmt.Sprintf("%v: stopped after %v lines", name, sent))
+			return false
+		}
+
+		// wait for a slot, the plugin is blocked on its output meanwhile
+		for {
+			z.limits.Lock()
+			wait := z.limits.take("stream", limit)
+			z.limits.Unlock()
+
+			if wait == 0 {
+				break
+			}
+
+			select {
+			case <-time.After(wait):
+			case <-j.cancelled:
+				return false
+			case <-z.ctx.Done():
+				return false
+			}
+		}
+
+		z.reply(msg, line)
+		sent++
+		return true
+	}
+
+	_, err := z.executePlugin(plugin, msg, args.tokens, runOptions{job: j, lines: lines})
+	return err
+}
@@ -0,0 +1,265 @@
+package main
+
+/*
+	Toad lifecycle: every toad runs in its own goroutine and reconnects
+	until its context is cancelled. Stopping a toad drains it: no new
+	messages are handled, running handlers (and plugins) are given
+	PluginGrace to finish, then the toad leaves with its Goodbye message.
+*/
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type toadRunner struct {
+	sync.Mutex
+
+	zhobe     *NeuroZhobe
+	cancel    context.CancelFunc
+	connected bool
+	done      chan bool // closed when the toad is stopped
+}
+
+// handlers may take that long to finish after their plugins are killed
+const drainSlack = time.Second * 5
+
+var (
+	// all the started toads, connected or not
+	runners     = map[string]*toadRunner{}
+	runnersSync sync.Mutex
+
+	// parent of all the toad contexts, cancelled on shutdown
+	rootCtx, shutdown = context.WithCancel(context.Background())
+)
+
+func applyDefaults(cfg *Config) {
+	if cfg.RestartTimeout == 0 {
+		cfg.RestartTimeout = time.Second * 2
+	}
+
+	if cfg.PluginGrace == 0 {
+		cfg.PluginGrace = time.Second * 5
+	}
+
+	if cfg.DaemonHealth == 0 {
+		cfg.DaemonHealth = time.Second * 30
+	}
+
+	if cfg.PluginTimeout == 0 {
+		cfg.PluginTimeout = time.Second * 30
+	}
+
+	if cfg.StreamLines == 0 {
+		cfg.StreamLines = 20
+	}
+}
+
+func newZhobe(ctx context.Context, name string, cfg *Config) *NeuroZhobe {
+	z := &NeuroZhobe{
+		ctx:  ctx,
+		name: name,
+		room: newRoomStore(),
+	}
+	z.setConfig(cfg)
+	return z
+}
+
+func startToad(name string, cfg Config) {
+
+	applyDefaults(&cfg)
+
+	ctx, cancel := context.WithCancel(rootCtx)
+
+	r := &toadRunner{
+		zhobe:  newZhobe(ctx, name, &cfg),
+		cancel: cancel,
+		done:   make(chan bool),
+	}
+
+	store, err := openStore(r.zhobe.storeFile())
+	if err != nil {
+		log.Printf("Could not start toad %v, its store is unusable: %v", name, err)
+		cancel()
+		return
+	}
+	r.zhobe.store = store
+
+	runnersSync.Lock()
+	runners[name] = r
+	runnersSync.Unlock()
+
+	log.Printf("Starting toad %v", name)
+	r.zhobe.importRoles()
+	r.zhobe.loadRoom()
+	go r.zhobe.keepRoom()
+	r.zhobe.watchPlugins()
+	r.zhobe.startDaemons()
+	go r.run()
+}
+
+func (r *toadRunner) run() {
+
+	defer close(r.done)
+
+	var (
+		zhobe = r.zhobe
+		name  = zhobe.name
+	)
+
+	for {
+		r.Lock()
+		if zhobe.ctx.Err() != nil {
+			r.Unlock()
+			return
+		}
+		zhobe.bot = zhobe.connect()
+		r.connected = true
+		r.Unlock()
+
+		// store this toad
+		toadsSync.Lock()
+		toads[name] = zhobe
+		toadsSync.Unlock()
+
+		zhobe.bot.Wait()
+
+		// unstore this toad so gsend won't work until it's really connected
+		toadsSync.Lock()
+		delete(toads, name)
+		toadsSync.Unlock()
+
+		// nobody is known to be there until the room is joined again
+		zhobe.room.leftAll()
+
+		r.Lock()
+		r.connected = false
+		// handlers, plugins and daemons may still be using it,
+		// freed bots ignore them
+		zhobe.forgetAnnounced()
+		zhobe.bot.Free()
+		r.Unlock()
+
+		// wait before reconnecting
+		select {
+		case <-zhobe.ctx.Done():
+			return
+		case <-time.After(zhobe.config().RestartTimeout):
+		}
+	}
+}
+
+// isConnected tells if the toad is connected, its bot is usable then
+func (z *NeuroZhobe) isConnected() bool {
+	toadsSync.RLock()
+	defer toadsSync.RUnlock()
+	return toads[z.name] == z
+}
+
+// begin registers a handler run, false if the toad is stopping
+func (z *NeuroZhobe) begin() bool {
+	z.inflightSync.Lock()
+	defer z.inflightSync.Unlock()
+
+	if z.ctx.Err() != nil {
+		return false
+	}
+
+	z.inflight.Add(1)
+	return true
+}
+
+func (z *NeuroZhobe) end() {
+	z.inflight.Done()
+}
+
+// drain waits for running handlers, false if it had to kill something
+// or gave up waiting, the context must be already cancelled
+func (z *NeuroZhobe) drain() bool {
+
+	// nobody is between the context check and Add after that
+	z.inflightSync.Lock()
+	z.inflightSync.Unlock()
+
+	drained := make(chan bool)
+	go func() {
+		z.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(z.config().PluginGrace + drainSlack):
+		log.Printf("Toad %v: handlers are still running, giving up", z.name)
+		return false
+	}
+
+	return atomic.LoadInt32(&z.killed) == 0
+}
+
+// stopToad returns false if the toad was not stopped cleanly
+func stopToad(name string) bool {
+
+	runnersSync.Lock()
+	r, found := runners[name]
+	delete(runners, name)
+	runnersSync.Unlock()
+
+	if !found {
+		return true
+	}
+
+	log.Printf("Stopping toad %v", name)
+
+	r.cancel()
+	r.zhobe.daemonsDone.Wait()
+	clean := r.zhobe.drain()
+
+	r.Lock()
+	if r.connected {
+		r.zhobe.bot.Leave(r.zhobe.config().Goodbye)
+	}
+	r.Unlock()
+
+	<-r.done
+
+	if err := r.zhobe.saveRoom(); err != nil {
+		log.Printf("Could not save room state: %v", err)
+	}
+
+	return clean
+}
+
+// stopAllToads returns false if any of toads was not stopped cleanly
+func stopAllToads() bool {
+
+	runnersSync.Lock()
+	var names []string
+	for name := range runners {
+		names = append(names, name)
+	}
+	runnersSync.Unlock()
+
+	var (
+		done  sync.WaitGroup
+		dirty int32
+	)
+
+	for _, name := range names {
+		done.Add(1)
+		go func(name string) {
+			if !stopToad(name) {
+				atomic.StoreInt32(&dirty, 1)
+			}
+			done.Done()
+		}(name)
+	}
+
+	// wait until all the toads are shutted down
+	done.Wait()
+
+	return dirty == 0
+}
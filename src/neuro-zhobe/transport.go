@@ -0,0 +1,52 @@
+package main
+
+import (
+	"console"
+	"glb"
+	"irc"
+	"reflect"
+)
+
+// connect creates the bot for configured transport and starts it
+// transports get copies of their configs, since they fill in defaults
+func (z *NeuroZhobe) connect() Bot {
+
+	switch z.config().Transport {
+	case "console":
+		var cfg console.Config
+		if z.config().Console != nil {
+			cfg = *z.config().Console
+		}
+
+		bot := console.New(z)
+		bot.Connect(&cfg)
+		return bot
+
+	case "irc":
+		cfg := *z.config().IRC
+
+		bot := irc.New(z)
+		bot.Connect(&cfg)
+		return bot
+
+	default:
+		cfg := *z.config().Jabber
+
+		bot := glb.New(z)
+		z.announce(bot)
+		bot.Connect(&cfg)
+		return bot
+	}
+}
+
+// restartNeeded is true if toad must be restarted to apply the new config:
+// connection settings or daemons are changed
+func restartNeeded(old, new *Config) bool {
+	// the store, the room state and the plugin index live in the root
+	return old.Root != new.Root ||
+		old.Transport != new.Transport ||
+		!reflect.DeepEqual(old.Jabber, new.Jabber) ||
+		!reflect.DeepEqual(old.Console, new.Console) ||
+		!reflect.DeepEqual(old.IRC, new.IRC) ||
+		!reflect.DeepEqual(old.Daemons, new.Daemons)
+}
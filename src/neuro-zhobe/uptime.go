@@ -9,11 +9,15 @@ import (
 var startupTime = time.Now()
 
 func init() {
-	commands["uptime"] = uptimeCmd
+	registerCommand(&command{
+		name:        "uptime",
+		description: "how long the bot is running",
+		handler:     uptimeCmd,
+	})
 }
 
-func uptimeCmd(z *NeuroZhobe, msg *glb.MUCMessage, params string) error {
+func uptimeCmd(z *NeuroZhobe, msg *glb.MUCMessage, args *arguments) error {
 
-	z.bot.Send(fmt.Sprintf("%v: %v", msg.From, time.Since(startupTime)))
+	z.reply(msg, fmt.Sprintf("%v: %v", msg.From, time.Since(startupTime)))
 	return nil
 }
@@ -1,18 +1,18 @@
 package main
 
 import (
+	"console"
+	"context"
 	"fmt"
 	"glb"
-	"io/ioutil"
+	"irc"
 	"log"
 	"os"
 	"os/signal"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-
-	"gopkg.in/yaml.v2"
 )
 
 var (
@@ -21,7 +21,8 @@ var (
 	msgHandlers []messageHandler
 
 	// all onConfig handlers are there
-	configLoadedHandlers []func()
+	// old config is nil when it's loaded for the first time
+	configLoadedHandlers []func(old, new *NeuroConfig)
 
 	// all the running toads are stored in there
 	toads     = map[string]*NeuroZhobe{}
@@ -29,191 +30,269 @@ var (
 
 	// global configuration
 	config *NeuroConfig
+
+	// answers to messages which did not come from the room
+	// (ad-hoc commands) are collected there instead of being sent
+	redirects     = map[*glb.MUCMessage]func(string){}
+	redirectsSync sync.Mutex
 )
 
 type (
 	messageHandler struct {
+		name     string
 		priority uint // the more priority is, the more important it is
-		cb       func(*NeuroZhobe, *glb.MUCMessage) (bool, error)
+		cb       handlerFunc
+	}
+
+	// what toads need from the transport (glb, console, irc)
+	Bot interface {
+		Disconnect()
+		Wait()
+		Free() // handlers may still call the bot after that, it must not break
+		Nickname() string
+		Send(message string)
+		SendPrivate(message, recipient string)
+		Kick(who, forWhat string)
+		SetSubject(subject string)
+		Leave(goodbye string) // leave the room and disconnect
 	}
 
 	NeuroZhobe struct {
-		bot     *glb.GBot
-		admins  map[string]bool
-		onlines map[string]bool
-		config  *Config
+		ctx  context.Context // cancelled when the toad is stopped
+		name string
+		bot  Bot
+		cfg  atomic.Value // *Config, swapped by reloads, see config()
+
+		room  roomStore
+		index pluginIndex
+		jobs  jobStore
+
+		// profile hash waiting for the server to accept the profile
+		profile struct {
+			sync.Mutex
+			key, hash string
+		}
+
+		// plugins exposed as ad-hoc commands, see announcePlugins()
+		adhoc struct {
+			sync.Mutex
+			bot     *glb.GBot
+			plugins map[string]bool
+		}
+
+		daemons     []*daemon
+		daemonsDone sync.WaitGroup
+		store       *kvStore
+		limits      limiter
+
+		// handlers being run, see drain()
+		inflight     sync.WaitGroup
+		inflightSync sync.Mutex
+		killed       int32 // plugins killed on shutdown
 	}
 
 	NeuroConfig struct {
+		Defaults  *Config // inherited by all the toads
 		Zhobe     map[string]Config
-		GsendHTTP string `yaml:"gsend_http"`
+		GsendHTTP string        `yaml:"gsend_http"`
+		Relays    []RelayConfig `yaml:"relay"`
+		StoreHTTP string        `yaml:"store_http"` // plugin store address, random loopback port by default
 	}
 
 	Config struct {
-		Jabber         *glb.Config
-		Root           string
-		GsendSecret    string        `yaml:"gsend_secret"`
-		RestartTimeout time.Duration `yaml:"restart_timeout"`
+		Transport       string // xmpp (default), console or irc
+		Jabber          *glb.Config
+		Console         *console.Config
+		IRC             *irc.Config
+		Root            string
+		GsendSecret     string        `yaml:"gsend_secret"`
+		RestartTimeout  time.Duration `yaml:"restart_timeout"`
+		Prefixes        []string      // command prefixes, "!" by default
+		SilentUnknown   bool          `yaml:"silent_unknown"` // don't answer WAT to unknown commands
+		Disable         []string      // names of handlers, filters and middlewares
+		Ignore          []string      // nicks
+		MaxReplyLength  int           `yaml:"max_reply_length"`
+		Roles           RolesConfig
+		PluginRoles     map[string]string        `yaml:"plugin_roles"` // plugin -> role
+		RateLimits      RateLimitsConfig         `yaml:"rate_limits"`
+		Goodbye         string                   // sent when leaving the room on shutdown
+		PluginGrace     time.Duration            `yaml:"plugin_grace"`     // how long plugins may run on shutdown, 5s by default
+		PluginTimeout   time.Duration            `yaml:"plugin_timeout"`   // 30s by default
+		PluginTimeouts  map[string]time.Duration `yaml:"plugin_timeouts"`  // plugin -> timeout
+		PluginSandbox   map[string]string        `yaml:"plugin_sandbox"`   // plugin -> sandbox profile, "default" by default
+		PluginProtocols map[string]string        `yaml:"plugin_protocols"` // plugin -> plain (default), json or stream
+		StreamLines     int                      `yaml:"stream_lines"`     // streamed lines per run, 20 by default
+		Daemons         []string                 // daemon plugins, see daemon.go
+		DaemonHealth    time.Duration            `yaml:"daemon_health"` // ping interval and timeout, 30s by default
+		SandboxProfiles map[string]SandboxConfig `yaml:"sandbox_profiles"`
 	}
 
-	PublicError error
+	// fine to show in the chat, see PublicError
+	publicError struct {
+		error
+	}
 )
 
+// PublicError marks the error as the one to send to the chat, everything
+// else is only shown to the operators
+func PublicError(err error) error {
+	return publicError{err}
+}
+
+// config of the toad, it may be replaced any time: get it once
+// if several settings must be consistent
+func (z *NeuroZhobe) config() *Config {
+	return z.cfg.Load().(*Config)
+}
+
+func (z *NeuroZhobe) setConfig(cfg *Config) {
+	z.cfg.Store(cfg)
+}
+
 func (z *NeuroZhobe) OnConnect() {
 	log.Println("Connected to server")
+
+	z.emit(daemonEvent{Event: "connect"})
+	go z.publishProfile()
+	go z.reportAllBroken()
 }
 
 func (z *NeuroZhobe) OnDisconnect(err error) {
 	log.Printf("Disconnected from server (err=%v)", err)
-}
 
-func (z *NeuroZhobe) OnMUCPresence(p *glb.MUCPresence) {
-	z.admins[p.Nick] = p.Online && p.Admin
-	z.onlines[p.Nick] = p.Online
+	event := daemonEvent{Event: "disconnect"}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	z.emit(event)
 }
 
-func (z *NeuroZhobe) OnMUCMessage(msg *glb.MUCMessage) {
-
-	if msg.History {
-		return // skip old messags
+func (z *NeuroZhobe) OnMUCPresence(p *glb.MUCPresence) {
+	if p.NewNick != "" {
+		log.Printf("%v is now known as %v", p.Nick, p.NewNick)
 	}
 
-	// Log message first
-	log.Printf("%v: %v", msg.From, msg.Body)
+	z.room.update(p)
 
-	if msg.From == z.bot.Nickname() {
-		return // skip self messages
-	}
+	z.emit(daemonEvent{
+		Event:       "presence",
+		Nick:        p.Nick,
+		Online:      p.Online,
+		NewNick:     p.NewNick,
+		JID:         p.JID,
+		Affiliation: p.Affiliation.String(),
+		Role:        p.Role.String(),
+	})
+}
 
-	for _, handler := range msgHandlers {
-		match, err := handler.cb(z, msg)
-		if err != nil {
-			if _, public := err.(PublicError); public {
-				// public errors can be directly sent to chat
-				z.bot.Send(fmt.Sprintf("%v: %v", msg.From, err.Error()))
-			} else {
-				// any other error is considered private
-				// and sent only to OP to PM
-				z.bot.Send(fmt.Sprintf("%v: 542 SHIT HAPPEND", msg.From))
-				if z.admins[msg.From] {
-					z.bot.SendPrivate(err.Error(), msg.From)
-				}
-				return
-			}
-		}
+func (z *NeuroZhobe) OnMUCSubject(from, subject string) {
+	log.Printf("%v changed the subject to: %v", from, subject)
 
-		if match {
-			return
-		}
-	}
+	z.emit(daemonEvent{Event: "subject", Nick: from, Subject: subject})
 }
 
-func readConfig() (*NeuroConfig, error) {
-
-	var configFileLocation = "./config.yaml"
-	if len(os.Args) >= 2 {
-		configFileLocation = os.Args[1]
+func (z *NeuroZhobe) OnMUCMessage(msg *glb.MUCMessage) {
+	if !z.begin() {
+		return // shutting down
 	}
+	defer z.end()
 
-	bytes, err := ioutil.ReadFile(configFileLocation)
-	if err != nil {
-		return nil, err
-	}
+	z.dispatch(msg)
+}
 
-	var result NeuroConfig
-	err = yaml.Unmarshal(bytes, &result)
+// redirect of the output, if the message didn't come from the room
+func redirected(msg *glb.MUCMessage) (func(string), bool) {
+	redirectsSync.Lock()
+	defer redirectsSync.Unlock()
 
-	return &result, err
+	redirect, found := redirects[msg]
+	return redirect, found
 }
 
-func prepareHandlers() {
-	// sort slice by its priority
-	sort.Slice(msgHandlers, func(i, j int) bool {
-		return msgHandlers[i].priority > msgHandlers[j].priority
-	})
+// reply sends command output to wherever the message came from
+func (z *NeuroZhobe) reply(msg *glb.MUCMessage, text string) {
+	text = z.filterReply(msg, text)
+
+	if redirect, found := redirected(msg); found {
+		redirect(text)
+		return
+	}
+
+	z.bot.Send(text)
 }
 
+// exit status
+const (
+	exitClean  = 0 // everything is stopped gracefully
+	exitConfig = 1 // config could not be read
+	exitDirty  = 2 // something had to be killed on shutdown
+	exitForced = 3 // second signal during shutdown
+)
+
 func main() {
 
+	if len(os.Args) >= 2 && os.Args[1] == sandboxCommand {
+		sandboxExec(os.Args[2:])
+	}
+
 	loadedConfig, err := readConfig()
 	if err != nil {
-		log.Fatal("Could not read config:", err)
+		log.Printf("Could not read config:\n%v", err)
+		os.Exit(exitConfig)
+	}
+
+	if len(os.Args) >= 2 && os.Args[1] == "check-config" {
+		fmt.Println("Config is fine")
+		return
 	}
+
 	config = loadedConfig
-	for _, cb := range configLoadedHandlers {
-		go cb()
+	prepareHandlers()
+
+	if err := startStoreServer(config.StoreHTTP); err != nil {
+		log.Printf("Could not start plugin store: %v", err)
+		os.Exit(exitConfig)
 	}
 
-	// bind shut-down
-	var (
-		sigs = make(chan os.Signal, 1)
-		stop bool
-		done sync.WaitGroup
-	)
+	for _, cb := range configLoadedHandlers {
+		go cb(nil, config)
+	}
 
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	// bind shut-down and reload
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	for name, cfg := range config.Zhobe {
-		var (
-			copy     = cfg
-			nameCopy = name
-		)
+		startToad(name, cfg)
+	}
 
-		if copy.RestartTimeout == 0 {
-			copy.RestartTimeout = time.Second * 2
+	// wait until termination signal
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			log.Printf("Got %v, shutting down", sig)
+			break
 		}
 
-		var zhobe = &NeuroZhobe{
-			admins:  make(map[string]bool),
-			onlines: make(map[string]bool),
-			config:  &copy,
+		if err := reloadConfig(); err != nil {
+			log.Printf("Could not reload config: %v", err)
 		}
-
-		done.Add(1)
-		go func() {
-
-			for !stop {
-
-				zhobe.bot = glb.New(zhobe)
-				zhobe.bot.Connect(copy.Jabber)
-
-				// store this toad
-				toadsSync.Lock()
-				toads[nameCopy] = zhobe
-				toadsSync.Unlock()
-
-				zhobe.bot.Wait()
-
-				// unstore this toad so gsend won't work until it's really connected
-				toadsSync.Lock()
-				delete(toads, nameCopy)
-				toadsSync.Unlock()
-
-				zhobe.bot.Free()
-
-				// wait before reconnecting
-				if !stop {
-					time.Sleep(copy.RestartTimeout)
-				}
-			}
-
-			done.Done()
-		}()
-
 	}
 
-	// wait until termination signal
-	<-sigs
-	stop = true
+	// one more signal means there is no time to wait for plugins
+	go func() {
+		for sig := range sigs {
+			if sig != syscall.SIGHUP {
+				log.Printf("Got %v again, exiting right now", sig)
+				os.Exit(exitForced)
+			}
+		}
+	}()
 
 	// call all toads for sleep
-	toadsSync.RLock()
-	for _, toad := range toads {
-		toad.bot.Disconnect()
+	shutdown()
+	if !stopAllToads() {
+		os.Exit(exitDirty)
 	}
-	toadsSync.RUnlock()
-
-	// wait until all the toads are shutted down
-	done.Wait()
 
+	os.Exit(exitClean)
 }